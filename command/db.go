@@ -0,0 +1,96 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/toby/det/server"
+)
+
+var dbMigrateDryRun bool
+var dbRollupDays int
+
+func init() {
+	dbMigrateCmd.Flags().BoolVar(&dbMigrateDryRun, "dry-run", false, "List pending migrations without applying them")
+	dbRollupCmd.Flags().IntVarP(&dbRollupDays, "days", "d", 0, "Roll up announces older than this many days (default AnnounceRetentionDays)")
+	dbCmd.AddCommand(dbMigrateCmd)
+	dbCmd.AddCommand(dbRollupCmd)
+	rootCmd.AddCommand(dbCmd)
+}
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Manage the torrent database",
+}
+
+var dbMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Apply pending schema migrations",
+	Args:  cobra.NoArgs,
+	RunE:  dbMigrateCmdRun,
+}
+
+func dbMigrateCmdRun(cmd *cobra.Command, args []string) error {
+	cfg := serverConfigFromDefaults()
+	db, err := server.OpenMigrator(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	v, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Schema version: %d (latest %d)\n", v, db.LatestSchemaVersion())
+	var ms []server.Migration
+	if dbMigrateDryRun {
+		ms, err = db.PendingMigrations()
+	} else {
+		ms, err = db.Migrate()
+	}
+	for _, m := range ms {
+		if dbMigrateDryRun {
+			fmt.Printf("Pending %d: %s\n", m.Version, m.Description)
+		} else {
+			fmt.Printf("Applied %d: %s\n", m.Version, m.Description)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(ms) == 0 {
+		fmt.Printf("Up to date\n")
+	}
+	return nil
+}
+
+var dbRollupCmd = &cobra.Command{
+	Use:   "rollup",
+	Short: "Roll up old announces into daily counts",
+	Args:  cobra.NoArgs,
+	RunE:  dbRollupCmdRun,
+}
+
+func dbRollupCmdRun(cmd *cobra.Command, args []string) error {
+	cfg := serverConfigFromDefaults()
+	days := cfg.AnnounceRetentionDays
+	if cmd.Flags().Changed("days") {
+		days = dbRollupDays
+	}
+	if days <= 0 {
+		return fmt.Errorf("Set --days or AnnounceRetentionDays to roll up announces")
+	}
+	db, err := server.NewStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	before := server.AnnounceRollupCutoff(time.Now(), days)
+	n, err := db.RollupAnnounces(before)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rolled up %d announces before %s\n", n, before.Format("2006-01-02"))
+	return nil
+}
@@ -2,18 +2,91 @@ package command
 
 import (
 	"fmt"
+	"os"
 	"regexp"
+	"strings"
 
 	"github.com/anacrolix/torrent"
 	"github.com/toby/det/server"
 )
 
-func printRankedTorrent(t server.Torrent) {
+func printRankedTorrent(t server.Torrent, mode server.RankMode, counter server.AnnounceCounter) {
 	name := t.Name
 	if name == "" {
 		name = "-- unresolved --"
 	}
-	fmt.Printf("%-9d %-80s magnet:?xt=urn:btih:%-40s\n", t.AnnounceCount, name, t.InfoHash)
+	fmt.Printf("%-9d %-80s magnet:?xt=urn:btih:%-40s\n", t.Rank(mode, counter), name, t.InfoHash)
+}
+
+// printTimelineTorrent prints the activity of t in its timeline bucket, or
+// its swarm size when ranking by swarm.
+func printTimelineTorrent(t server.TimelineTorrent, mode server.RankMode) {
+	name := t.Name
+	if name == "" {
+		name = "-- unresolved --"
+	}
+	count := t.Count
+	if mode == server.RankSwarm {
+		count = t.Swarm.Size()
+	}
+	fmt.Printf("%-9d %-80s magnet:?xt=urn:btih:%-40s\n", count, name, t.InfoHash)
+}
+
+// printTrendingTorrent prints the announces of t in the trend window and
+// their change from the previous window.
+func printTrendingTorrent(t server.TrendingTorrent) {
+	name := t.Name
+	if name == "" {
+		name = "-- unresolved --"
+	}
+	change := "new"
+	if t.Previous > 0 {
+		change = fmt.Sprintf("%+d%%", (t.Current-t.Previous)*100/t.Previous)
+	}
+	fmt.Printf("%-9d %-7s %-80s magnet:?xt=urn:btih:%-40s\n", t.Current, change, name, t.InfoHash)
+}
+
+// printSearchResult prints r like printRankedTorrent, followed by its
+// highlighted snippet.
+func printSearchResult(r server.SearchResult, counter server.AnnounceCounter) {
+	printRankedTorrent(r.Torrent, server.RankSupply, counter)
+	if r.Snippet != "" {
+		fmt.Printf("%-9s %s\n", "", highlight(r.Snippet))
+	}
+	if r.File != nil && r.FileCount > 1 {
+		fmt.Printf("%-9s file %d of %d, %s\n", "", r.File.Index+1, r.FileCount, formatBytes(r.File.Length))
+	}
+}
+
+// highlight shows the matched words of a snippet in bold on a terminal and
+// in brackets otherwise.
+func highlight(s string) string {
+	start, end := "[", "]"
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		start, end = "\x1b[1m", "\x1b[0m"
+	}
+	s = strings.Replace(s, server.HighlightStart, start, -1)
+	return strings.Replace(s, server.HighlightEnd, end, -1)
+}
+
+const categoryUsage = "Only show torrents in category (video, audio, software, ebook, archive, image or other)"
+
+// parseCategoryFlag returns the Category named by a --category flag, which
+// may be empty.
+func parseCategoryFlag(s string) (server.Category, error) {
+	if s == "" {
+		return "", nil
+	}
+	return server.ParseCategory(s)
+}
+
+func printUnresolvedTorrent(t server.Torrent) {
+	state := "retry"
+	if t.Dead {
+		state = "dead"
+	}
+	fmt.Printf("%-40s %-5s %-3d %-16s %-9d %s\n", t.InfoHash, state, t.ResolveAttempts,
+		t.LastAttemptAt.Format("2006-01-02 15:04"), t.AnnounceCount, t.LastFailure)
 }
 
 func printTorrentStats(t *torrent.Torrent) {
@@ -25,6 +98,43 @@ func printTorrentStats(t *torrent.Torrent) {
 	fmt.Printf("Half Open Peers:   %d\n", t.Stats().HalfOpenPeers)
 }
 
+// formatBytes returns n in binary units, e.g. 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// sparkBlocks are the bars of a sparkline, from lowest to highest.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws values as a line of bars scaled to the largest. Zeros are
+// left blank.
+func sparkline(values []int) string {
+	max := 0
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	var b strings.Builder
+	for _, v := range values {
+		if v <= 0 {
+			b.WriteRune(' ')
+			continue
+		}
+		b.WriteRune(sparkBlocks[(v*len(sparkBlocks)-1)/max])
+	}
+	return b.String()
+}
+
 func underline(s string) string {
 	r := regexp.MustCompile(".")
 	u := r.ReplaceAllString(s, "-")
@@ -0,0 +1,61 @@
+package command
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/toby/det/server"
+)
+
+var exportOutput string
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "Output file (default HASH.torrent)")
+}
+
+var exportCmd = &cobra.Command{
+	Use:     "export HASH",
+	Short:   "Export a resolved torrent as a .torrent file",
+	Aliases: []string{"e"},
+	Args:    cobra.ExactArgs(1),
+	RunE:    exportCmdRun,
+}
+
+func exportCmdRun(cmd *cobra.Command, args []string) error {
+	hx := strings.ToLower(args[0])
+	cfg := serverConfigFromDefaults()
+	db, err := server.NewStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ib, err := db.GetTorrentInfo(hx)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("No stored info for %s", hx)
+	} else if err != nil {
+		return err
+	}
+	mi, err := server.MetaInfoForInfoBytes(ib, cfg.AnnounceList)
+	if err != nil {
+		return err
+	}
+	out := exportOutput
+	if out == "" {
+		out = hx + ".torrent"
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = mi.Write(f); err != nil {
+		return err
+	}
+	log.Printf("Exported: %s", out)
+	return nil
+}
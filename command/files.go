@@ -0,0 +1,97 @@
+package command
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/toby/det/server"
+)
+
+func init() {
+	rootCmd.AddCommand(filesCmd)
+}
+
+var filesCmd = &cobra.Command{
+	Use:     "files HASH",
+	Short:   "Show the file tree of a resolved torrent",
+	Aliases: []string{"f"},
+	Args:    cobra.ExactArgs(1),
+	RunE:    filesCmdRun,
+}
+
+// fileNode is a file or directory in a torrent's file tree. Directory
+// lengths are the total of the files below them.
+type fileNode struct {
+	name     string
+	length   int64
+	children map[string]*fileNode
+}
+
+func (n *fileNode) add(path []string, length int64) {
+	n.length += length
+	if len(path) == 0 {
+		return
+	}
+	if n.children == nil {
+		n.children = make(map[string]*fileNode)
+	}
+	c, ok := n.children[path[0]]
+	if !ok {
+		c = &fileNode{name: path[0]}
+		n.children[path[0]] = c
+	}
+	c.add(path[1:], length)
+}
+
+func (n *fileNode) print(indent string) {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := n.children[name]
+		if c.children != nil {
+			name += "/"
+		}
+		fmt.Printf("%9s  %s%s\n", formatBytes(c.length), indent, name)
+		c.print(indent + "  ")
+	}
+}
+
+func filesCmdRun(cmd *cobra.Command, args []string) error {
+	hx := strings.ToLower(args[0])
+	cfg := serverConfigFromDefaults()
+	db, err := server.NewStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	t, err := db.GetTorrent(hx)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("Unknown torrent: %s", hx)
+	} else if err != nil {
+		return err
+	}
+	if t.ResolvedAt.IsZero() {
+		return fmt.Errorf("Torrent not resolved: %s", hx)
+	}
+	fis, err := db.GetFileInfo(hx)
+	if err != nil {
+		return err
+	}
+	root := &fileNode{}
+	for _, fi := range fis {
+		root.add(strings.Split(fi.Path, "/"), fi.Length)
+	}
+	fmt.Printf("%s\n", underline(t.Name))
+	root.print("")
+	fmt.Printf("%9s  %d files\n", formatBytes(t.Length), len(fis))
+	if t.FilesStale {
+		fmt.Printf("\nThese files were stored as path components by an older det, the torrent is queued to be resolved again.\n")
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package command
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/toby/det/server"
+)
+
+var historyBuckets int
+var historyGranularity string
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.Flags().IntVarP(&historyBuckets, "buckets", "b", 30, "Limit number of hours, days or weeks")
+	historyCmd.Flags().StringVarP(&historyGranularity, "granularity", "g", "day", "Count announces by hour, day or week")
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history HASH",
+	Short: "Show the announces of a torrent over time",
+	Args:  cobra.ExactArgs(1),
+	RunE:  historyCmdRun,
+}
+
+// historyMarker returns the index of the bucket of hs that t falls in, or
+// -1 if t is zero or outside them.
+func historyMarker(hs []server.HistoryBucket, t time.Time) int {
+	if t.IsZero() || len(hs) == 0 || t.Before(hs[0].Start) {
+		return -1
+	}
+	for i := len(hs) - 1; i >= 0; i-- {
+		if !t.Before(hs[i].Start) {
+			return i
+		}
+	}
+	return -1
+}
+
+func historyCmdRun(cmd *cobra.Command, args []string) error {
+	hx := strings.ToLower(args[0])
+	granularity, err := server.ParseGranularity(historyGranularity)
+	if err != nil {
+		return err
+	}
+	cfg := serverConfigFromDefaults()
+	if err = checkRolledUpHours(cfg, granularity, historyBuckets); err != nil {
+		return err
+	}
+	db, err := server.NewStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	t, err := db.GetTorrent(hx)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("Unknown torrent: %s", hx)
+	} else if err != nil {
+		return err
+	}
+	hs, err := db.AnnounceHistory(hx, historyBuckets, granularity)
+	if err != nil {
+		return err
+	}
+	name := t.Name
+	if name == "" {
+		name = "-- unresolved --"
+	}
+	fmt.Printf("%s\n", underline(name))
+	fmt.Printf("First seen  %s\n", t.CreatedAt.UTC().Format(time.RFC1123))
+	if t.ResolvedAt.IsZero() {
+		fmt.Printf("Resolved    never\n")
+	} else {
+		fmt.Printf("Resolved    %s\n", t.ResolvedAt.UTC().Format(time.RFC1123))
+	}
+	println()
+
+	// The sparkline is drawn with F and R markers below it at the
+	// buckets the torrent was first seen and resolved in.
+	counts := make([]int, len(hs))
+	for i, h := range hs {
+		counts[i] = h.Announces
+	}
+	seen, resolved := historyMarker(hs, t.CreatedAt), historyMarker(hs, t.ResolvedAt)
+	markers := []rune(strings.Repeat(" ", len(hs)))
+	if seen >= 0 {
+		markers[seen] = 'F'
+	}
+	if resolved >= 0 {
+		markers[resolved] = 'R'
+	}
+	fmt.Printf("%s\n%s\n\n", sparkline(counts), strings.TrimRight(string(markers), " "))
+
+	fmt.Printf("%-24s %9s %10s\n", "Start", "Announces", "Announcers")
+	for i, h := range hs {
+		var notes []string
+		if i == seen {
+			notes = append(notes, "first seen")
+		}
+		if i == resolved {
+			notes = append(notes, "resolved")
+		}
+		line := fmt.Sprintf("%-24s %9d %10d  %s", h.Start.Format(timelineFormats[granularity]),
+			h.Announces, h.Announcers, strings.Join(notes, ", "))
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+	return nil
+}
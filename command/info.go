@@ -19,7 +19,7 @@ var infoCmd = &cobra.Command{
 
 func infoCmdRun(cmd *cobra.Command, args []string) error {
 	cfg := serverConfigFromDefaults()
-	db, err := server.NewSqliteDB(cfg.SqlitePath)
+	db, err := server.NewStore(cfg)
 	if err != nil {
 		return err
 	}
@@ -30,7 +30,14 @@ func infoCmdRun(cmd *cobra.Command, args []string) error {
 	}
 	p := message.NewPrinter(message.MatchLanguage("en"))
 	p.Printf("Torrents:\t%v\n", stats.Torrents)
+	p.Printf("Looked up only:\t%v\n", stats.LookupOnly)
 	p.Printf("Resolved:\t%v\n", stats.Resolved)
-	p.Printf("Announces:\t%v\n", stats.Announces)
+	p.Printf("Queued:\t\t%v\n", stats.Queued)
+	p.Printf("Hinted:\t\t%v of %v resolved\n", stats.HintedResolves, stats.HintedAttempts)
+	p.Printf("Announces:\t%v (%v raw)\n", stats.Announces, stats.RawAnnounces)
+	p.Printf("Announce IPs:\t%v\n", stats.AnnounceIPs)
+	p.Printf("Lookups:\t%v\n", stats.Lookups)
+	p.Printf("Swarm Samples:\t%v\n", stats.SwarmSamples)
+	p.Printf("Tracker Scrapes:\t%v\n", stats.TrackerScrapes)
 	return nil
 }
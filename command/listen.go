@@ -5,8 +5,15 @@ import (
 	"github.com/toby/det/server"
 )
 
+var listenCrawl bool
+var listenSwarm bool
+var listenScrape bool
+
 func init() {
 	rootCmd.AddCommand(listenCmd)
+	listenCmd.Flags().BoolVarP(&listenCrawl, "crawl", "c", false, "Actively crawl the DHT for infohashes (BEP 51)")
+	listenCmd.Flags().BoolVarP(&listenSwarm, "swarm", "w", false, "Sample swarm sizes of resolved torrents with DHT get_peers")
+	listenCmd.Flags().BoolVar(&listenScrape, "scrape", false, "Scrape trackers of resolved torrents")
 }
 
 var listenCmd = &cobra.Command{
@@ -20,6 +27,9 @@ func listenCmdRun(cmd *cobra.Command, args []string) error {
 	cfg := serverConfigFromDefaults()
 	cfg.Listen = true
 	cfg.Seed = true
+	cfg.Crawl = cfg.Crawl || listenCrawl
+	cfg.SwarmSample = cfg.SwarmSample || listenSwarm
+	cfg.TrackerScrape = cfg.TrackerScrape || listenScrape
 	s, err := server.NewServer(cfg)
 	if err != nil {
 		return err
@@ -8,10 +8,18 @@ import (
 )
 
 var popularLimit int
+var popularRank string
+var popularDead bool
+var popularCount string
+var popularCategory string
 
 func init() {
 	rootCmd.AddCommand(popularCmd)
 	popularCmd.Flags().IntVarP(&popularLimit, "limit", "l", 50, "Limit results")
+	popularCmd.Flags().BoolVar(&popularDead, "dead", false, "Include torrents that failed to resolve too many times")
+	popularCmd.Flags().StringVarP(&popularCount, "count", "c", "distinct", "Count distinct announcers or raw announces")
+	popularCmd.Flags().StringVar(&popularCategory, "category", "", categoryUsage)
+	popularCmd.Flags().StringVarP(&popularRank, "rank", "r", "supply", "Rank by supply (announces), demand (lookups), combined or swarm (sampled swarm size)")
 }
 
 var popularCmd = &cobra.Command{
@@ -23,19 +31,31 @@ var popularCmd = &cobra.Command{
 }
 
 func popularCmdRun(cmd *cobra.Command, args []string) error {
+	mode, err := server.ParseRankMode(popularRank)
+	if err != nil {
+		return err
+	}
+	counter, err := server.ParseAnnounceCounter(popularCount)
+	if err != nil {
+		return err
+	}
+	category, err := parseCategoryFlag(popularCategory)
+	if err != nil {
+		return err
+	}
 	cfg := serverConfigFromDefaults()
-	db, err := server.NewSqliteDB(cfg.SqlitePath)
+	db, err := server.NewStore(cfg)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	ts, err := db.PopularTorrents(popularLimit)
+	ts, err := db.PopularTorrents(popularLimit, mode, counter, server.SearchFilter{Category: category}, popularDead)
 	if err != nil {
 		log.Printf("ERROR: %s", err)
 		return err
 	}
 	for _, t := range ts {
-		printRankedTorrent(t)
+		printRankedTorrent(t, mode, counter)
 	}
 	return nil
 }
@@ -21,8 +21,10 @@ func init() {
 	viper.SetDefault("ListenPort", 42069)
 	viper.SetDefault("PublicHost", "")
 	viper.SetDefault("DisableUpnp", false)
-	viper.SetDefault("HashQueueLength", 500)
+	viper.SetDefault("HashQueueLength", 100000)
+	viper.SetDefault("Store", server.StoreSQLite)
 	viper.SetDefault("SqlitePath", "./")
+	viper.SetDefault("PostgresURL", "")
 	viper.SetDefault("BoltDBPath", "./")
 	viper.SetDefault("DownloadPath", "./")
 	viper.SetDefault("Listen", true)
@@ -30,7 +32,29 @@ func init() {
 	viper.SetDefault("NumResolvers", 5)
 	viper.SetDefault("ResolverTimeout", time.Second*30)
 	viper.SetDefault("ResolverWindow", time.Minute*10)
+	viper.SetDefault("ResolverBackoff", time.Minute*10)
+	viper.SetDefault("ResolverMaxBackoff", time.Hour*24)
+	viper.SetDefault("ResolverMaxAttempts", 8)
 	viper.SetDefault("TorrentDebug", false)
+	viper.SetDefault("AnnounceIPMode", server.AnnounceIPStore)
+	viper.SetDefault("AnnounceIPSalt", "")
+	viper.SetDefault("Crawl", false)
+	viper.SetDefault("CrawlRate", 10)
+	viper.SetDefault("CrawlMaxNodes", 10000)
+	viper.SetDefault("CrawlNodeInterval", time.Minute*10)
+	viper.SetDefault("DHTIdentities", 0)
+	viper.SetDefault("IngestBatchSize", 500)
+	viper.SetDefault("IngestFlushInterval", time.Second)
+	viper.SetDefault("IngestQueueLength", 10000)
+	viper.SetDefault("AnnounceList", server.BuiltinAnnounceList)
+	viper.SetDefault("SwarmSample", false)
+	viper.SetDefault("SwarmSampleRate", 30)
+	viper.SetDefault("SwarmSampleInterval", time.Hour*6)
+	viper.SetDefault("TrackerScrape", false)
+	viper.SetDefault("TrackerScrapeRate", 30)
+	viper.SetDefault("TrackerScrapeInterval", time.Hour*6)
+	viper.SetDefault("ScrapeAnnounceList", false)
+	viper.SetDefault("AnnounceRetentionDays", 0)
 }
 
 func serverConfigFromDefaults() *server.Config {
@@ -39,7 +63,9 @@ func serverConfigFromDefaults() *server.Config {
 	cfg.ListenPort = viper.GetInt("ListenPort")
 	cfg.DisableUpnp = viper.GetBool("DisableUpnp")
 	cfg.HashQueueLength = viper.GetInt("HashQueueLength")
+	cfg.Store = viper.GetString("Store")
 	cfg.SqlitePath = viper.GetString("SqlitePath")
+	cfg.PostgresURL = viper.GetString("PostgresURL")
 	cfg.BoltDBPath = viper.GetString("BoltDBPath")
 	cfg.DownloadPath = viper.GetString("DownloadPath")
 	cfg.Listen = viper.GetBool("Listen")
@@ -47,8 +73,32 @@ func serverConfigFromDefaults() *server.Config {
 	cfg.NumResolvers = viper.GetInt("NumResolvers")
 	cfg.ResolverTimeout = viper.GetDuration("ResolverTimeout")
 	cfg.ResolverWindow = viper.GetDuration("ResolverWindow")
+	cfg.ResolverBackoff = viper.GetDuration("ResolverBackoff")
+	cfg.ResolverMaxBackoff = viper.GetDuration("ResolverMaxBackoff")
+	cfg.ResolverMaxAttempts = viper.GetInt("ResolverMaxAttempts")
 	cfg.TorrentDebug = viper.GetBool("TorrentDebug")
 	cfg.PublicHost = viper.GetString("PublicHost")
+	cfg.AnnounceIPMode = viper.GetString("AnnounceIPMode")
+	cfg.AnnounceIPSalt = viper.GetString("AnnounceIPSalt")
+	cfg.Crawl = viper.GetBool("Crawl")
+	cfg.CrawlRate = viper.GetInt("CrawlRate")
+	cfg.CrawlMaxNodes = viper.GetInt("CrawlMaxNodes")
+	cfg.CrawlNodeInterval = viper.GetDuration("CrawlNodeInterval")
+	cfg.DHTIdentities = viper.GetInt("DHTIdentities")
+	cfg.IngestBatchSize = viper.GetInt("IngestBatchSize")
+	cfg.IngestFlushInterval = viper.GetDuration("IngestFlushInterval")
+	cfg.IngestQueueLength = viper.GetInt("IngestQueueLength")
+	cfg.SwarmSample = viper.GetBool("SwarmSample")
+	cfg.SwarmSampleRate = viper.GetInt("SwarmSampleRate")
+	cfg.SwarmSampleInterval = viper.GetDuration("SwarmSampleInterval")
+	cfg.TrackerScrape = viper.GetBool("TrackerScrape")
+	cfg.TrackerScrapeRate = viper.GetInt("TrackerScrapeRate")
+	cfg.TrackerScrapeInterval = viper.GetDuration("TrackerScrapeInterval")
+	cfg.ScrapeAnnounceList = viper.GetBool("ScrapeAnnounceList")
+	cfg.AnnounceRetentionDays = viper.GetInt("AnnounceRetentionDays")
+	if err := viper.UnmarshalKey("AnnounceList", &cfg.AnnounceList); err != nil {
+		cfg.AnnounceList = server.BuiltinAnnounceList
+	}
 	return cfg
 }
 
@@ -0,0 +1,63 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/toby/det/server"
+)
+
+var scrapeTrackers []string
+
+func init() {
+	rootCmd.AddCommand(scrapeCmd)
+	scrapeCmd.Flags().StringSliceVarP(&scrapeTrackers, "tracker", "t", nil, "Tracker announce URL to scrape instead of the torrent's own")
+}
+
+var scrapeCmd = &cobra.Command{
+	Use:   "scrape HASH",
+	Short: "Scrape a torrent's trackers for seeders and leechers",
+	Args:  cobra.ExactArgs(1),
+	RunE:  scrapeCmdRun,
+}
+
+func scrapeCmdRun(cmd *cobra.Command, args []string) error {
+	hx := strings.ToLower(args[0])
+	cfg := serverConfigFromDefaults()
+	db, err := server.NewStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	trackers := scrapeTrackers
+	if len(trackers) == 0 {
+		trackers, err = db.GetTrackers(hx)
+		if err != nil {
+			return err
+		}
+		if cfg.ScrapeAnnounceList {
+			for _, tier := range cfg.AnnounceList {
+				trackers = append(trackers, tier...)
+			}
+		}
+	}
+	if len(trackers) == 0 {
+		return fmt.Errorf("No trackers to scrape for %s", hx)
+	}
+	scrapes := make([]server.TrackerScrape, 0)
+	for _, tr := range trackers {
+		ts, err := server.ScrapeTracker(tr, hx)
+		if err != nil {
+			fmt.Printf("%-50s error: %s\n", tr, err)
+			continue
+		}
+		fmt.Printf("%-50s seeders %-6d leechers %-6d completed %d\n", tr, ts.Seeders, ts.Leechers, ts.Completed)
+		scrapes = append(scrapes, ts)
+	}
+	if _, err = db.GetTorrent(hx); err == nil {
+		return db.RecordTrackerScrapes(hx, time.Now(), scrapes)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"fmt"
 	"log"
 	"strings"
 
@@ -9,10 +10,23 @@ import (
 )
 
 var searchLimit int
+var searchCount string
+var searchFilter server.SearchFilter
+var searchCategory string
+var searchGroup bool
+var searchSort string
 
 func init() {
 	rootCmd.AddCommand(searchCmd)
 	searchCmd.Flags().IntVarP(&searchLimit, "limit", "l", 50, "Limit results")
+	searchCmd.Flags().StringVarP(&searchCount, "count", "c", "distinct", "Count distinct announcers or raw announces")
+	searchCmd.Flags().BoolVar(&searchFilter.NoPrivate, "no-private", false, "Hide private torrents")
+	searchCmd.Flags().BoolVar(&searchFilter.SingleFile, "single-file", false, "Only show single-file torrents")
+	searchCmd.Flags().BoolVar(&searchFilter.MultiFile, "multi-file", false, "Only show multi-file torrents")
+	searchCmd.Flags().StringVar(&searchFilter.Source, "source", "", "Only show torrents with this info source")
+	searchCmd.Flags().StringVar(&searchCategory, "category", "", categoryUsage)
+	searchCmd.Flags().BoolVarP(&searchGroup, "group", "g", false, "Group results by release title, e.g. episodes of a series")
+	searchCmd.Flags().StringVarP(&searchSort, "sort", "s", "relevance", "Rank by text relevance, popularity or both (relevance, popular or blended)")
 }
 
 var searchCmd = &cobra.Command{
@@ -24,20 +38,42 @@ var searchCmd = &cobra.Command{
 }
 
 func searchCmdRun(cmd *cobra.Command, args []string) error {
+	counter, err := server.ParseAnnounceCounter(searchCount)
+	if err != nil {
+		return err
+	}
+	order, err := server.ParseSearchOrder(searchSort)
+	if err != nil {
+		return err
+	}
+	searchFilter.Category, err = parseCategoryFlag(searchCategory)
+	if err != nil {
+		return err
+	}
 	cfg := serverConfigFromDefaults()
-	db, err := server.NewSqliteDB(cfg.SqlitePath)
+	db, err := server.NewStore(cfg)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 	term := strings.Join(args, " ")
 	log.Printf("Searching: \"%s\"\n", term)
-	rows, err := db.SearchTorrents(term, searchLimit)
+	rows, err := db.SearchTorrents(term, searchLimit, order, counter, searchFilter)
 	if err != nil {
 		return err
 	}
-	for _, t := range rows {
-		printRankedTorrent(t)
+	if searchGroup {
+		for _, g := range server.GroupReleases(rows) {
+			fmt.Printf("%s\n", underline(g.Title))
+			for _, r := range g.Results {
+				printSearchResult(r, counter)
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+	for _, r := range rows {
+		printSearchResult(r, counter)
 	}
 	return nil
 }
@@ -2,44 +2,107 @@ package command
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/toby/det/server"
 )
 
+var timelineBuckets int
 var timelineDays int
+var timelineGranularity string
 var timelineLimit int
+var timelineRank string
+var timelineCount string
+var timelineCategory string
+
+// timelineFormats are the layouts of the bucket start times, which are in
+// UTC.
+var timelineFormats = map[server.Granularity]string{
+	server.GranularityHour: "Mon Jan _2 15:04 MST",
+	server.GranularityDay:  "Mon Jan _2",
+	server.GranularityWeek: "Week of Mon Jan _2",
+}
 
 func init() {
 	rootCmd.AddCommand(timelineCmd)
+	timelineCmd.Flags().IntVarP(&timelineBuckets, "buckets", "b", 10, "Limit number of hours, days or weeks")
+	timelineCmd.Flags().StringVarP(&timelineGranularity, "granularity", "g", "day", "Bucket torrents by hour, day or week")
+	timelineCmd.Flags().IntVarP(&timelineLimit, "limit", "l", 10, "Limit results per bucket")
 	timelineCmd.Flags().IntVarP(&timelineDays, "days", "d", 10, "Limit number of days")
-	timelineCmd.Flags().IntVarP(&timelineLimit, "limit", "l", 10, "Limit results per day")
+	timelineCmd.Flags().MarkDeprecated("days", "use --buckets")
+	timelineCmd.Flags().StringVarP(&timelineCount, "count", "c", "distinct", "Count distinct announcers or raw announces")
+	timelineCmd.Flags().StringVar(&timelineCategory, "category", "", categoryUsage)
+	timelineCmd.Flags().StringVarP(&timelineRank, "rank", "r", "supply", "Rank by supply (announces), demand (lookups), combined or swarm (sampled swarm size)")
 }
 
 var timelineCmd = &cobra.Command{
 	Use:     "timeline",
-	Short:   "Timeline resolved torrents",
+	Short:   "Timeline of the most active torrents",
 	Aliases: []string{"s"},
 	Args:    cobra.ArbitraryArgs,
 	RunE:    timelineCmdRun,
 }
 
+// checkRolledUpHours refuses hourly buckets reaching back past
+// AnnounceRetentionDays, where announces are only kept as daily counts in
+// the middle of their day.
+func checkRolledUpHours(cfg *server.Config, granularity server.Granularity, buckets int) error {
+	if granularity != server.GranularityHour || cfg.AnnounceRetentionDays <= 0 {
+		return nil
+	}
+	now := time.Now().UTC().Truncate(time.Hour)
+	cutoff := server.AnnounceRollupCutoff(now, cfg.AnnounceRetentionDays)
+	max := int(now.Sub(cutoff)/time.Hour) + 1
+	if buckets > max {
+		return fmt.Errorf("Announces before %s are rolled up into daily counts, use --granularity=day or at most --buckets=%d",
+			cutoff.Format("2006-01-02"), max)
+	}
+	return nil
+}
+
 func timelineCmdRun(cmd *cobra.Command, args []string) error {
+	mode, err := server.ParseRankMode(timelineRank)
+	if err != nil {
+		return err
+	}
+	granularity, err := server.ParseGranularity(timelineGranularity)
+	if err != nil {
+		return err
+	}
+	counter, err := server.ParseAnnounceCounter(timelineCount)
+	if err != nil {
+		return err
+	}
+	category, err := parseCategoryFlag(timelineCategory)
+	if err != nil {
+		return err
+	}
+	buckets := timelineBuckets
+	if cmd.Flags().Changed("days") {
+		if granularity != server.GranularityDay || cmd.Flags().Changed("buckets") {
+			return fmt.Errorf("--days only works with --granularity=day and without --buckets")
+		}
+		buckets = timelineDays
+	}
 	cfg := serverConfigFromDefaults()
-	db, err := server.NewSqliteDB(cfg.SqlitePath)
+	if err = checkRolledUpHours(cfg, granularity, buckets); err != nil {
+		return err
+	}
+	db, err := server.NewStore(cfg)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	tl, err := db.TimelineTorrents(timelineDays, timelineLimit)
+	tl, err := db.TimelineTorrents(buckets, granularity, timelineLimit, mode, counter, server.SearchFilter{Category: category})
 	if err != nil {
 		return err
 	}
 	for _, entry := range tl {
 		if len(entry.Torrents) > 0 {
-			fmt.Printf("%s\n", underline(entry.Day.Format("Mon Jan _2")))
+			fmt.Printf("%s\n", underline(entry.Start.Format(timelineFormats[granularity])))
 			for _, t := range entry.Torrents {
-				printRankedTorrent(t)
+				printTimelineTorrent(t, mode)
 			}
 			println()
 		}
@@ -0,0 +1,56 @@
+package command
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/toby/det/server"
+)
+
+var trendingLimit int
+var trendingWindow string
+var trendingView string
+var trendingCategory string
+
+func init() {
+	rootCmd.AddCommand(trendingCmd)
+	trendingCmd.Flags().IntVarP(&trendingLimit, "limit", "l", 50, "Limit results")
+	trendingCmd.Flags().StringVarP(&trendingWindow, "window", "w", "24h", "Count announces over this many whole hours or days, e.g. 1h, 24h or 7d")
+	trendingCmd.Flags().StringVar(&trendingView, "view", "hot", "Rank by recent announces (hot), or by change from the previous window (rising or falling)")
+	trendingCmd.Flags().StringVar(&trendingCategory, "category", "", categoryUsage)
+}
+
+var trendingCmd = &cobra.Command{
+	Use:     "trending",
+	Short:   "List torrents with the most recent announces",
+	Aliases: []string{"t"},
+	Args:    cobra.NoArgs,
+	RunE:    trendingCmdRun,
+}
+
+func trendingCmdRun(cmd *cobra.Command, args []string) error {
+	window, err := server.ParseTrendWindow(trendingWindow)
+	if err != nil {
+		return err
+	}
+	view, err := server.ParseTrendView(trendingView)
+	if err != nil {
+		return err
+	}
+	category, err := parseCategoryFlag(trendingCategory)
+	if err != nil {
+		return err
+	}
+	cfg := serverConfigFromDefaults()
+	db, err := server.NewStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ts, err := db.TrendingTorrents(window, trendingLimit, view, server.SearchFilter{Category: category})
+	if err != nil {
+		return err
+	}
+	for _, t := range ts {
+		printTrendingTorrent(t)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package command
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/toby/det/server"
+)
+
+var unresolvedLimit int
+var unresolvedDead bool
+
+func init() {
+	rootCmd.AddCommand(unresolvedCmd)
+	unresolvedCmd.Flags().IntVarP(&unresolvedLimit, "limit", "l", 50, "Limit results")
+	unresolvedCmd.Flags().BoolVar(&unresolvedDead, "dead", false, "Only list dead torrents")
+}
+
+var unresolvedCmd = &cobra.Command{
+	Use:     "unresolved",
+	Short:   "List torrents that failed to resolve",
+	Aliases: []string{"u"},
+	Args:    cobra.NoArgs,
+	RunE:    unresolvedCmdRun,
+}
+
+func unresolvedCmdRun(cmd *cobra.Command, args []string) error {
+	cfg := serverConfigFromDefaults()
+	db, err := server.NewStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ts, err := db.UnresolvedTorrents(unresolvedLimit, unresolvedDead)
+	if err != nil {
+		return err
+	}
+	for _, t := range ts {
+		printUnresolvedTorrent(t)
+	}
+	return nil
+}
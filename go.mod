@@ -4,6 +4,7 @@ require (
 	github.com/anacrolix/dht/v2 v2.0.3
 	github.com/anacrolix/torrent v1.7.0
 	github.com/hashicorp/golang-lru v0.5.3 // indirect
+	github.com/lib/pq v1.1.1
 	github.com/mattn/go-sqlite3 v1.10.0
 	github.com/muesli/cache2go v0.0.0-20190609140403-5eb79359852d
 	github.com/neelance/parallel v0.0.0-20160708114440-4de9ce63d14c // indirect
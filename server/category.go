@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Category is the kind of content in a torrent, classified from the
+// extensions and sizes of its files. Unclassified torrents have an empty
+// Category.
+type Category string
+
+const (
+	CategoryVideo    Category = "video"
+	CategoryAudio    Category = "audio"
+	CategorySoftware Category = "software"
+	CategoryEbook    Category = "ebook"
+	CategoryArchive  Category = "archive"
+	CategoryImage    Category = "image"
+	CategoryOther    Category = "other"
+)
+
+// Categories are the categories a torrent can be classified as.
+var Categories = []Category{
+	CategoryVideo,
+	CategoryAudio,
+	CategorySoftware,
+	CategoryEbook,
+	CategoryArchive,
+	CategoryImage,
+	CategoryOther,
+}
+
+// ParseCategory returns the Category named s.
+func ParseCategory(s string) (Category, error) {
+	for _, c := range Categories {
+		if string(c) == s {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown category: %s", s)
+}
+
+var categoryExtensions = map[Category][]string{
+	CategoryVideo:    {"mkv", "mp4", "avi", "m4v", "mov", "wmv", "mpg", "mpeg", "ts", "m2ts", "webm", "flv", "vob", "divx", "ogv"},
+	CategoryAudio:    {"mp3", "flac", "m4a", "aac", "ogg", "opus", "wav", "wma", "ape", "alac", "aiff", "m4b", "dsf"},
+	CategorySoftware: {"exe", "msi", "dmg", "pkg", "deb", "rpm", "apk", "appimage", "bin", "img", "iso", "dll", "jar"},
+	CategoryEbook:    {"epub", "mobi", "azw", "azw3", "pdf", "djvu", "cbr", "cbz", "fb2", "lit", "chm"},
+	CategoryArchive:  {"zip", "rar", "7z", "tar", "gz", "tgz", "bz2", "xz", "zst"},
+	CategoryImage:    {"jpg", "jpeg", "png", "gif", "bmp", "tif", "tiff", "webp", "heic", "raw", "cr2", "nef", "psd"},
+}
+
+// ignoredExtensions are files that come along with any kind of content and
+// say nothing about it.
+var ignoredExtensions = map[string]bool{
+	"nfo": true, "txt": true, "sfv": true, "md5": true, "url": true, "srt": true,
+	"sub": true, "idx": true, "ass": true, "log": true, "db": true, "par2": true,
+}
+
+var extensionCategory = func() map[string]Category {
+	m := make(map[string]Category)
+	for c, exts := range categoryExtensions {
+		for _, e := range exts {
+			m[e] = c
+		}
+	}
+	return m
+}()
+
+// multiPartArchive matches the numbered volumes of split rar archives.
+func multiPartArchive(ext string) bool {
+	if len(ext) != 3 || (ext[0] != 'r' && ext[0] != 's') {
+		return false
+	}
+	return ext[1] >= '0' && ext[1] <= '9' && ext[2] >= '0' && ext[2] <= '9'
+}
+
+func fileCategory(p string) (Category, bool) {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(p), "."))
+	if ignoredExtensions[ext] {
+		return "", false
+	}
+	if c, ok := extensionCategory[ext]; ok {
+		return c, true
+	}
+	if multiPartArchive(ext) {
+		return CategoryArchive, true
+	}
+	return CategoryOther, true
+}
+
+// Classify returns the category of a torrent with files and the confidence
+// of the classification, between 0 and 1. Each file votes for the category
+// of its extension with half its share of the torrent's bytes and half its
+// share of the file count, so a single large video outweighs its cover art
+// while a folder of many small images still counts as images. Files like
+// .nfo and subtitles don't vote.
+func Classify(files []FileInfo) (Category, float64) {
+	var total int64
+	var count int
+	bytes := make(map[Category]int64)
+	counts := make(map[Category]int)
+	for _, f := range files {
+		c, ok := fileCategory(f.Path)
+		if !ok {
+			continue
+		}
+		bytes[c] += f.Length
+		counts[c]++
+		total += f.Length
+		count++
+	}
+	if count == 0 {
+		return CategoryOther, 0
+	}
+	best, score := CategoryOther, -1.0
+	for _, c := range Categories {
+		if counts[c] == 0 {
+			continue
+		}
+		s := float64(counts[c]) / float64(count)
+		if total > 0 {
+			s = (s + float64(bytes[c])/float64(total)) / 2
+		}
+		if s > score {
+			best, score = c, s
+		}
+	}
+	return best, score
+}
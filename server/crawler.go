@@ -0,0 +1,265 @@
+package server
+
+import (
+	"encoding/hex"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/krpc"
+)
+
+const (
+	// crawlQueryTimeout is how long to wait for a sample_infohashes reply.
+	crawlQueryTimeout = time.Second * 10
+
+	// crawlMaxFailures is the number of failed queries in a row after which
+	// a node is forgotten.
+	crawlMaxFailures = 3
+
+	// crawlRetryBackoff is how long to wait before querying a node again
+	// after its first failed query. It doubles with every failure.
+	crawlRetryBackoff = time.Minute
+
+	// crawlUnsupportedTTL is how long a node without BEP 51 support is kept
+	// from being crawled again.
+	crawlUnsupportedTTL = time.Hour * 24
+
+	// crawlStatsInterval is how often crawl progress is logged.
+	crawlStatsInterval = time.Minute * 5
+)
+
+// sampleInfohashesReply is the response dictionary for BEP 51
+// sample_infohashes. Samples is nil when the reply has no samples key.
+type sampleInfohashesReply struct {
+	ID       krpc.ID                  `bencode:"id"`
+	Interval int                      `bencode:"interval"`
+	Nodes    krpc.CompactIPv4NodeInfo `bencode:"nodes,omitempty"`
+	Num      int                      `bencode:"num"`
+	Samples  *string                  `bencode:"samples"`
+}
+
+// crawlNode is the crawler's bookkeeping for a single DHT node.
+type crawlNode struct {
+	addr     *net.UDPAddr
+	next     time.Time
+	inflight bool
+	failures int
+	queries  int
+	samples  int
+}
+
+// crawlStats are running totals for a crawl.
+type crawlStats struct {
+	Queries     int
+	Replies     int
+	Unsupported int
+	Samples     int
+	NewHashes   int
+}
+
+// crawler grows the index actively by walking the DHT and sending BEP 51
+// sample_infohashes queries to nodes that support it. Each node is queried
+// no more often than the interval it asks for, or CrawlNodeInterval if that
+// is longer, and the crawl as a whole is limited to CrawlRate queries per
+// second. Nodes without BEP 51 support are dropped and remembered in
+// unsupported, so they aren't re-added from the routing table until
+// crawlUnsupportedTTL has passed. Both sets are capped at CrawlMaxNodes.
+type crawler struct {
+	s           *Server
+	c           *krpcClient
+	mu          sync.Mutex
+	nodes       map[string]*crawlNode
+	unsupported map[string]time.Time
+	stats       crawlStats
+	stop        chan struct{}
+}
+
+func newCrawler(s *Server) (*crawler, error) {
+	c, err := newKRPCClient(s.config.ListenHost)
+	if err != nil {
+		return nil, err
+	}
+	return &crawler{
+		s:           s,
+		c:           c,
+		nodes:       make(map[string]*crawlNode),
+		unsupported: make(map[string]time.Time),
+		stop:        make(chan struct{}),
+	}, nil
+}
+
+// Run crawls until Close is called.
+func (cr *crawler) Run() {
+	rate := cr.s.config.CrawlRate
+	if rate <= 0 {
+		rate = 1
+	}
+	tick := time.NewTicker(time.Second / time.Duration(rate))
+	defer tick.Stop()
+	report := time.NewTicker(crawlStatsInterval)
+	defer report.Stop()
+	for {
+		select {
+		case <-cr.stop:
+			return
+		case <-report.C:
+			cr.mu.Lock()
+			st, n := cr.stats, len(cr.nodes)
+			cr.mu.Unlock()
+			log.Printf("Crawl:\tnodes %d\tqueries %d\treplies %d\tunsupported %d\tsamples %d\tnew %d",
+				n, st.Queries, st.Replies, st.Unsupported, st.Samples, st.NewHashes)
+		case <-tick.C:
+			n := cr.nextNode()
+			if n == nil {
+				cr.addRoutingTableNodes()
+				continue
+			}
+			go cr.sample(n)
+		}
+	}
+}
+
+// Close stops the crawl.
+func (cr *crawler) Close() {
+	close(cr.stop)
+	cr.c.Close()
+}
+
+// nextNode returns a node that is due to be queried and marks it in flight.
+func (cr *crawler) nextNode() *crawlNode {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	now := time.Now()
+	for _, n := range cr.nodes {
+		if !n.inflight && now.After(n.next) {
+			n.inflight = true
+			return n
+		}
+	}
+	return nil
+}
+
+// addRoutingTableNodes seeds the crawl with the nodes known to our DHT
+// servers.
+func (cr *crawler) addRoutingTableNodes() {
+	for _, d := range cr.s.dhtServers() {
+		cr.addNodes(d.Nodes())
+	}
+}
+
+func (cr *crawler) addNodes(nis []krpc.NodeInfo) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	now := time.Now()
+	for _, ni := range nis {
+		if len(cr.nodes) >= cr.s.config.CrawlMaxNodes {
+			return
+		}
+		if ni.Addr.Port == 0 || ni.Addr.IP.IsUnspecified() {
+			continue
+		}
+		k := ni.Addr.String()
+		if _, ok := cr.nodes[k]; ok {
+			continue
+		}
+		if at, ok := cr.unsupported[k]; ok {
+			if now.Sub(at) < crawlUnsupportedTTL {
+				continue
+			}
+			delete(cr.unsupported, k)
+		}
+		cr.nodes[k] = &crawlNode{addr: ni.Addr.UDP()}
+	}
+}
+
+// markUnsupported drops the node k from the crawl and remembers it as
+// unsupported. Expired entries are pruned when the set is full, and if it
+// is still full an arbitrary entry makes room. Must be called with mu held.
+func (cr *crawler) markUnsupported(k string) {
+	delete(cr.nodes, k)
+	now := time.Now()
+	if len(cr.unsupported) >= cr.s.config.CrawlMaxNodes {
+		for u, at := range cr.unsupported {
+			if now.Sub(at) >= crawlUnsupportedTTL {
+				delete(cr.unsupported, u)
+			}
+		}
+	}
+	for u := range cr.unsupported {
+		if len(cr.unsupported) < cr.s.config.CrawlMaxNodes {
+			break
+		}
+		delete(cr.unsupported, u)
+	}
+	cr.unsupported[k] = now
+}
+
+func (cr *crawler) sample(n *crawlNode) {
+	var r sampleInfohashesReply
+	target := krpc.ID(dht.RandomNodeID())
+	err := cr.c.Query(n.addr, "sample_infohashes", &krpc.MsgArgs{Target: target}, &r, crawlQueryTimeout)
+	select {
+	case <-cr.stop:
+		return
+	default:
+	}
+	_, krpcErr := err.(krpc.Error)
+
+	cr.mu.Lock()
+	cr.stats.Queries++
+	n.inflight = false
+	n.queries++
+	switch {
+	case err != nil && !krpcErr:
+		// Timeouts, socket errors and undecodable replies say nothing
+		// about BEP 51 support, so the node is retried later.
+		if err != errKRPCTimeout {
+			log.Printf("Crawl error querying %s: %s", n.addr, err)
+		}
+		n.failures++
+		if n.failures >= crawlMaxFailures {
+			delete(cr.nodes, n.addr.String())
+		} else {
+			n.next = time.Now().Add(crawlRetryBackoff << uint(n.failures-1))
+		}
+		cr.mu.Unlock()
+		return
+	case err != nil || r.Samples == nil:
+		// Error replies and replies without a samples key come from nodes
+		// that don't implement BEP 51.
+		cr.markUnsupported(n.addr.String())
+		cr.stats.Unsupported++
+		cr.mu.Unlock()
+		cr.addNodes(r.Nodes)
+		return
+	}
+	n.failures = 0
+	interval := time.Duration(r.Interval) * time.Second
+	if interval < cr.s.config.CrawlNodeInterval {
+		interval = cr.s.config.CrawlNodeInterval
+	}
+	n.next = time.Now().Add(interval)
+	samples := len(*r.Samples) / 20
+	n.samples += samples
+	cr.stats.Replies++
+	cr.stats.Samples += samples
+	cr.mu.Unlock()
+
+	cr.addNodes(r.Nodes)
+	for i := 0; i < samples; i++ {
+		hx := hex.EncodeToString([]byte((*r.Samples)[i*20 : (i+1)*20]))
+		added, err := cr.s.queueNewHash(hx)
+		if err != nil {
+			log.Printf("Crawl error adding hash: %s", err)
+			continue
+		}
+		if added {
+			cr.mu.Lock()
+			cr.stats.NewHashes++
+			cr.mu.Unlock()
+		}
+	}
+}
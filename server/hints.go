@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+const (
+	// maxHintPeers caps the announcer endpoints given to the resolver for a
+	// single infohash.
+	maxHintPeers = 16
+
+	// hintLifetime is how long announcer endpoints are remembered in memory
+	// after the last announce of an infohash.
+	hintLifetime = time.Hour
+)
+
+// hintSet holds recent announcer endpoints for an infohash.
+type hintSet struct {
+	mu    sync.Mutex
+	peers []torrent.Peer
+}
+
+// addHint remembers that the node at ip and port announced it is in the
+// swarm for hx. An announcer is very likely to have the metadata so it's
+// handed to the resolver as an initial peer. Hints are kept in memory
+// whatever the AnnounceIPMode.
+func (s *Server) addHint(hx string, ip net.IP, port int) {
+	if ip == nil || port <= 0 || port > 65535 {
+		return
+	}
+	var hs *hintSet
+	if item, err := s.hintCache.Value(hx); err == nil {
+		hs = item.Data().(*hintSet)
+	} else {
+		hs = &hintSet{}
+		s.hintCache.Add(hx, hintLifetime, hs)
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for _, p := range hs.peers {
+		if p.Port == port && p.IP.Equal(ip) {
+			return
+		}
+	}
+	if len(hs.peers) >= maxHintPeers {
+		hs.peers = hs.peers[1:]
+	}
+	hs.peers = append(hs.peers, torrent.Peer{IP: ip, Port: port})
+}
+
+// hintPeers returns the announcer endpoints known for hx, from memory and,
+// when announcer IPs are stored, from the db.
+func (s *Server) hintPeers(hx string) []torrent.Peer {
+	ret := make([]torrent.Peer, 0)
+	seen := make(map[string]bool)
+	add := func(p torrent.Peer) {
+		k := net.JoinHostPort(p.IP.String(), strconv.Itoa(p.Port))
+		if len(ret) < maxHintPeers && !seen[k] {
+			seen[k] = true
+			ret = append(ret, p)
+		}
+	}
+	if item, err := s.hintCache.Value(hx); err == nil {
+		hs := item.Data().(*hintSet)
+		hs.mu.Lock()
+		for _, p := range hs.peers {
+			add(p)
+		}
+		hs.mu.Unlock()
+	}
+	if s.config.AnnounceIPMode == AnnounceIPStore {
+		as, _ := s.db.GetAnnouncers(hx)
+		for _, a := range as {
+			ip := net.ParseIP(a.IP)
+			if ip != nil && a.Port > 0 && a.Port <= 65535 {
+				add(torrent.Peer{IP: ip, Port: a.Port})
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// dhtIdentity is a DHT node run by the Server. Identity 0 is the torrent
+// client's own DHT server. Additional virtual identities are added with
+// Config.DHTIdentities to widen the part of the keyspace we hear announces
+// for, since nodes mostly receive announces for infohashes near their ID.
+type dhtIdentity struct {
+	index     int
+	server    *dht.Server
+	announces int64
+	lookups   int64
+}
+
+// IdentityStats are the queries received by one of the Server's DHT
+// identities.
+type IdentityStats struct {
+	Index     int
+	ID        metainfo.Hash
+	Addr      string
+	Nodes     int
+	Announces int64
+	Lookups   int64
+}
+
+// onQuery counts query for the identity before passing it to the Server.
+func (di *dhtIdentity) onQuery(s *Server) func(*krpc.Msg, net.Addr) bool {
+	return func(query *krpc.Msg, source net.Addr) bool {
+		switch query.Q {
+		case "announce_peer":
+			atomic.AddInt64(&di.announces, 1)
+		case "get_peers":
+			atomic.AddInt64(&di.lookups, 1)
+		}
+		return s.onQuery(query, source)
+	}
+}
+
+func (di *dhtIdentity) stats() IdentityStats {
+	st := IdentityStats{
+		Index:     di.index,
+		Announces: atomic.LoadInt64(&di.announces),
+		Lookups:   atomic.LoadInt64(&di.lookups),
+	}
+	if di.server != nil {
+		id := di.server.ID()
+		st.ID = metainfo.HashBytes(id[:])
+		st.Addr = di.server.Addr().String()
+		st.Nodes = di.server.Stats().Nodes
+	}
+	return st
+}
+
+// spreadNodeID returns a random node ID whose first 32 bits place it at the
+// start of the i-th of n equal slices of the 160-bit keyspace.
+func spreadNodeID(i, n int) [20]byte {
+	id := dht.RandomNodeID()
+	prefix := uint32((uint64(i) << 32) / uint64(n))
+	binary.BigEndian.PutUint32(id[:4], prefix)
+	return id
+}
+
+// startIdentities starts Config.DHTIdentities virtual DHT servers. Each binds
+// the port after the previous one, starting at ListenPort+1, or a random port
+// if ListenPort is 0.
+func (s *Server) startIdentities() error {
+	n := s.config.DHTIdentities
+	for i := 0; i < n; i++ {
+		port := 0
+		if s.config.ListenPort != 0 {
+			port = s.config.ListenPort + 1 + i
+		}
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(s.config.ListenHost, strconv.Itoa(port)))
+		if err != nil {
+			return fmt.Errorf("DHT identity %d: %s", i+1, err)
+		}
+		di := &dhtIdentity{index: i + 1}
+		ds, err := dht.NewServer(&dht.ServerConfig{
+			NodeId:        spreadNodeID(i, n),
+			Conn:          conn,
+			NoSecurity:    true,
+			StartingNodes: dht.GlobalBootstrapAddrs,
+			OnQuery:       di.onQuery(s),
+		})
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("DHT identity %d: %s", i+1, err)
+		}
+		di.server = ds
+		s.identities = append(s.identities, di)
+		log.Printf("DHT Identity %d: %x on %s", di.index, ds.ID(), ds.Addr())
+		go func() {
+			if _, err := ds.Bootstrap(); err != nil {
+				log.Printf("DHT identity %d bootstrap error: %s", di.index, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// IdentityStats returns query counts for each of the Server's DHT
+// identities.
+func (s *Server) IdentityStats() []IdentityStats {
+	ret := make([]IdentityStats, 0, len(s.identities))
+	for _, di := range s.identities {
+		ret = append(ret, di.stats())
+	}
+	return ret
+}
+
+// dhtServers returns the torrent client's DHT servers followed by those of
+// the virtual identities.
+func (s *Server) dhtServers() []*dht.Server {
+	ret := append([]*dht.Server{}, s.client.DhtServers()...)
+	for _, di := range s.identities[1:] {
+		ret = append(ret, di.server)
+	}
+	return ret
+}
+
+func (s *Server) closeIdentities() {
+	for _, di := range s.identities[1:] {
+		di.server.Close()
+	}
+}
+
+func (s *Server) logIdentityStats() {
+	for _, st := range s.IdentityStats() {
+		log.Printf("DHT Identity %d:\t%s\tnodes %d\tannounces %d\tlookups %d",
+			st.Index, st.ID.HexString(), st.Nodes, st.Announces, st.Lookups)
+	}
+}
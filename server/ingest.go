@@ -0,0 +1,224 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// ingestDefaultInterval is the flush interval used when
+	// IngestFlushInterval isn't positive.
+	ingestDefaultInterval = time.Second
+
+	// ingestMaxRetries is how many times a failed batch is retried, once
+	// every flush interval, before its records are dropped.
+	ingestMaxRetries = 3
+
+	// ingestRateInterval is how often the writer samples its write rate.
+	ingestRateInterval = time.Second * 10
+)
+
+// ingestRecord is a DHT query waiting to be written. Queue adds the hash to
+// the resolve queue.
+type ingestRecord struct {
+	at       time.Time
+	announce *Announce
+	lookup   *Lookup
+	queue    string
+}
+
+// IngestStats describe the ingest writer. Rate is records written per second
+// over the last ingestRateInterval. Lag is how long the oldest record
+// in the last batch waited to be committed, and MaxLag the longest wait so
+// far. Dropped counts records discarded because the writer fell more than
+// IngestQueueLength records behind, or because their batch still failed
+// after ingestMaxRetries retries. Failed counts failed batch writes.
+type IngestStats struct {
+	Written int64
+	Batches int64
+	Dropped int64
+	Failed  int64
+	Pending int
+	Rate    float64
+	Lag     time.Duration
+	MaxLag  time.Duration
+}
+
+// ingestWriter writes announces, lookups and resolve queue additions from a
+// single goroutine, batching them into transactions that are committed
+// every IngestBatchSize records or IngestFlushInterval, whichever is first.
+// This keeps db writes off the DHT query handlers. A batch that fails to
+// commit is kept and retried on the next flush, along with any records added
+// since. forget is called with the queued hashes of records that are dropped,
+// so they can be queued again.
+type ingestWriter struct {
+	db        Store
+	records   chan ingestRecord
+	batchSize int
+	interval  time.Duration
+	forget    func(hx string)
+	failures  int
+	stop      chan struct{}
+	done      chan struct{}
+
+	mu        sync.Mutex
+	stats     IngestStats
+	lastCount int64
+	lastTime  time.Time
+}
+
+func newIngestWriter(db Store, cfg *Config, forget func(hx string)) *ingestWriter {
+	size := cfg.IngestBatchSize
+	if size <= 0 {
+		size = 1
+	}
+	interval := cfg.IngestFlushInterval
+	if interval <= 0 {
+		interval = ingestDefaultInterval
+	}
+	return &ingestWriter{
+		db:        db,
+		records:   make(chan ingestRecord, cfg.IngestQueueLength),
+		batchSize: size,
+		interval:  interval,
+		forget:    forget,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		lastTime:  time.Now(),
+	}
+}
+
+// Add hands r to the writer. It never blocks. If the writer is too far
+// behind r is dropped.
+func (w *ingestWriter) Add(r ingestRecord) bool {
+	r.at = time.Now()
+	select {
+	case w.records <- r:
+		return true
+	default:
+		w.mu.Lock()
+		w.stats.Dropped++
+		w.mu.Unlock()
+		if r.queue != "" {
+			w.forget(r.queue)
+		}
+		return false
+	}
+}
+
+// Run writes records until Close is called.
+func (w *ingestWriter) Run() {
+	defer close(w.done)
+	tick := time.NewTicker(w.interval)
+	defer tick.Stop()
+	rate := time.NewTicker(ingestRateInterval)
+	defer rate.Stop()
+	batch := make([]ingestRecord, 0, w.batchSize)
+	for {
+		select {
+		case r := <-w.records:
+			batch = append(batch, r)
+			// After a failure the batch waits for the next tick.
+			if len(batch) >= w.batchSize && w.failures == 0 {
+				batch = w.flush(batch)
+			}
+		case <-tick.C:
+			batch = w.flush(batch)
+		case <-rate.C:
+			w.sampleRate()
+		case <-w.stop:
+			for {
+				select {
+				case r := <-w.records:
+					batch = append(batch, r)
+				default:
+					for len(batch) > 0 {
+						batch = w.flush(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close flushes every record added so far and stops the writer.
+func (w *ingestWriter) Close() {
+	close(w.stop)
+	<-w.done
+}
+
+// flush writes batch and returns the records left to write: none if it was
+// committed or dropped, or the whole batch to retry.
+func (w *ingestWriter) flush(batch []ingestRecord) []ingestRecord {
+	if len(batch) == 0 {
+		return batch
+	}
+	b := IngestBatch{
+		Announces: make([]Announce, 0),
+		Lookups:   make([]Lookup, 0),
+		Queue:     make([]string, 0),
+	}
+	for _, r := range batch {
+		if r.announce != nil {
+			b.Announces = append(b.Announces, *r.announce)
+		}
+		if r.lookup != nil {
+			b.Lookups = append(b.Lookups, *r.lookup)
+		}
+		if r.queue != "" {
+			b.Queue = append(b.Queue, r.queue)
+		}
+	}
+	if err := w.db.WriteBatch(b); err != nil {
+		log.Printf("WriteBatch Error:\t%s", err)
+		w.failures++
+		w.mu.Lock()
+		w.stats.Failed++
+		if w.failures <= ingestMaxRetries {
+			w.mu.Unlock()
+			return batch
+		}
+		w.stats.Dropped += int64(len(batch))
+		w.mu.Unlock()
+		log.Printf("Ingest dropped %d records after %d retries", len(batch), ingestMaxRetries)
+		for _, hx := range b.Queue {
+			w.forget(hx)
+		}
+		w.failures = 0
+		return batch[:0]
+	}
+	w.failures = 0
+	lag := time.Since(batch[0].at)
+	w.mu.Lock()
+	w.stats.Written += int64(len(batch))
+	w.stats.Batches++
+	w.stats.Lag = lag
+	if lag > w.stats.MaxLag {
+		w.stats.MaxLag = lag
+	}
+	w.mu.Unlock()
+	return batch[:0]
+}
+
+// sampleRate sets Rate from the records written since the last sample.
+func (w *ingestWriter) sampleRate() {
+	now := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if d := now.Sub(w.lastTime).Seconds(); d > 0 {
+		w.stats.Rate = float64(w.stats.Written-w.lastCount) / d
+	}
+	w.lastCount = w.stats.Written
+	w.lastTime = now
+}
+
+// Stats returns the writer's throughput and lag.
+func (w *ingestWriter) Stats() IngestStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := w.stats
+	st.Pending = len(w.records)
+	return st
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dht/v2"
+	"github.com/anacrolix/dht/v2/krpc"
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// errKRPCTimeout is returned when a KRPC query gets no reply in time.
+var errKRPCTimeout = errors.New("KRPC query timeout")
+
+// krpcReply is a KRPC response or error with the response dictionary left
+// bencoded so each query can decode the fields it needs.
+type krpcReply struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	R bencode.Bytes `bencode:"r,omitempty"`
+	E *krpc.Error   `bencode:"e,omitempty"`
+}
+
+// krpcPending is a query waiting for its reply, which must come from addr.
+type krpcPending struct {
+	addr *net.UDPAddr
+	ch   chan krpcReply
+}
+
+// krpcClient sends KRPC queries from its own UDP socket. It is used for
+// queries the DHT server in anacrolix/dht doesn't expose, such as BEP 51
+// sample_infohashes. Queries are sent read-only (BEP 43) since the client
+// never answers queries itself. Replies are matched to queries by
+// transaction ID and the address queried.
+type krpcClient struct {
+	conn    net.PacketConn
+	id      krpc.ID
+	mu      sync.Mutex
+	txID    uint16
+	pending map[string]krpcPending
+}
+
+func newKRPCClient(host string) (*krpcClient, error) {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	c := &krpcClient{
+		conn:    conn,
+		id:      dht.RandomNodeID(),
+		pending: make(map[string]krpcPending),
+	}
+	go c.serve()
+	return c, nil
+}
+
+// Query sends q with args a to addr and decodes the response dictionary
+// into r. An error response from the remote node is returned as a
+// krpc.Error.
+func (c *krpcClient) Query(addr *net.UDPAddr, q string, a *krpc.MsgArgs, r interface{}, timeout time.Duration) error {
+	a.ID = c.id
+	c.mu.Lock()
+	c.txID++
+	t := make([]byte, 2)
+	binary.BigEndian.PutUint16(t, c.txID)
+	ch := make(chan krpcReply, 1)
+	c.pending[string(t)] = krpcPending{addr, ch}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, string(t))
+		c.mu.Unlock()
+	}()
+
+	b, err := bencode.Marshal(krpc.Msg{
+		T:        string(t),
+		Y:        "q",
+		Q:        q,
+		A:        a,
+		ReadOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.WriteTo(b, addr)
+	if err != nil {
+		return err
+	}
+	select {
+	case m := <-ch:
+		if m.E != nil {
+			return *m.E
+		}
+		return bencode.Unmarshal(m.R, r)
+	case <-time.After(timeout):
+		return errKRPCTimeout
+	}
+}
+
+// Close stops the client. Outstanding queries will time out.
+func (c *krpcClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *krpcClient) serve() {
+	b := make([]byte, 0x10000)
+	for {
+		n, from, err := c.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		var m krpcReply
+		if err := bencode.Unmarshal(b[:n], &m); err != nil {
+			continue
+		}
+		if m.Y != "r" && m.Y != "e" {
+			continue
+		}
+		c.mu.Lock()
+		p, ok := c.pending[m.T]
+		c.mu.Unlock()
+		if ok && sameUDPAddr(from, p.addr) {
+			select {
+			case p.ch <- m:
+			default:
+			}
+		}
+	}
+}
+
+// sameUDPAddr reports whether the reply address from is addr.
+func sameUDPAddr(from net.Addr, addr *net.UDPAddr) bool {
+	u, ok := from.(*net.UDPAddr)
+	return ok && u.Port == addr.Port && u.IP.Equal(addr.IP)
+}
@@ -0,0 +1,909 @@
+package server
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps the index in memory. It answers the
+// same queries as the SQL stores and is meant for tests and short lived
+// nodes, since nothing is kept when it is closed.
+type MemoryStore struct {
+	mu           sync.Mutex
+	torrents     map[string]*memTorrent
+	files        map[string][]FileInfo
+	infos        map[string][]byte
+	announces    map[string][]Announcer
+	announceDays map[memAnnounceBucket]memAnnounceCounts
+	// announceHours counts every announce, repeats included, by hour.
+	announceHours map[memAnnounceBucket]int
+	// announceSeen holds the nodes of rolled up announces by torrent.
+	announceSeen map[string]map[string]bool
+	lookups      map[string][]time.Time
+	queue        map[string]*memQueued
+	search       map[string][]memSearch
+	trackers     map[string][]string
+	swarmSamples int64
+	scrapes      int64
+}
+
+// memTorrent is a stored torrent and the resolver state that isn't part of
+// Torrent.
+type memTorrent struct {
+	Torrent
+	lookupOnly       bool
+	retryAt          time.Time
+	hintedAttempts   int
+	resolvedWithHint int
+	swarmFailedAt    time.Time
+}
+
+type memQueued struct {
+	seenAt  time.Time
+	started bool
+}
+
+// memAnnounceBucket is a torrent and the UTC day or hour, as the unix time
+// it starts, that announces are counted in.
+type memAnnounceBucket struct {
+	hash  string
+	start int64
+}
+
+// memAnnounceCounts are the announces and distinct announcers rolled up to
+// a day.
+type memAnnounceCounts struct {
+	announces  int
+	announcers int
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		torrents:      make(map[string]*memTorrent),
+		files:         make(map[string][]FileInfo),
+		infos:         make(map[string][]byte),
+		announces:     make(map[string][]Announcer),
+		announceDays:  make(map[memAnnounceBucket]memAnnounceCounts),
+		announceHours: make(map[memAnnounceBucket]int),
+		announceSeen:  make(map[string]map[string]bool),
+		lookups:       make(map[string][]time.Time),
+		queue:         make(map[string]*memQueued),
+		search:        make(map[string][]memSearch),
+		trackers:      make(map[string][]string),
+	}
+}
+
+func (me *MemoryStore) Close() error {
+	return nil
+}
+
+func (me *MemoryStore) Stats() (*Stats, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	stats := &Stats{
+		Torrents:       int64(len(me.torrents)),
+		Queued:         int64(len(me.queue)),
+		SwarmSamples:   me.swarmSamples,
+		TrackerScrapes: me.scrapes,
+	}
+	ips := make(map[string]bool)
+	for _, as := range me.announces {
+		stats.Announces += int64(len(as))
+		for _, a := range as {
+			if a.IP != "" {
+				ips[a.IP] = true
+			}
+		}
+	}
+	stats.AnnounceIPs = int64(len(ips))
+	for _, c := range me.announceDays {
+		stats.Announces += int64(c.announcers)
+	}
+	for _, ls := range me.lookups {
+		stats.Lookups += int64(len(ls))
+	}
+	for _, t := range me.torrents {
+		if t.lookupOnly {
+			stats.Torrents--
+			stats.LookupOnly++
+		}
+		stats.RawAnnounces += int64(t.RawAnnounceCount)
+		stats.HintedAttempts += int64(t.hintedAttempts)
+		stats.HintedResolves += int64(t.resolvedWithHint)
+		if !t.ResolvedAt.IsZero() {
+			stats.Resolved++
+		}
+	}
+	return stats, nil
+}
+
+func (me *MemoryStore) CreateTorrent(hash string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.createTorrent(hash)
+	return nil
+}
+
+func (me *MemoryStore) createTorrent(hash string) {
+	if _, ok := me.torrents[hash]; !ok {
+		me.torrents[hash] = &memTorrent{Torrent: Torrent{InfoHash: hash, CreatedAt: time.Now()}}
+	}
+}
+
+// CreateAnnounce records an announce of hash by the DHT node peerId from
+// the endpoint ip and port.
+func (me *MemoryStore) CreateAnnounce(hash string, peerId string, ip string, port int, impliedPort bool) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.createAnnounce(Announce{hash, peerId, ip, port, impliedPort})
+	return nil
+}
+
+func (me *MemoryStore) createAnnounce(a Announce) {
+	repeat := me.announceSeen[a.InfoHash][a.PeerID]
+	for _, o := range me.announces[a.InfoHash] {
+		if o.PeerID == a.PeerID {
+			repeat = true
+			break
+		}
+	}
+	if !repeat {
+		me.announces[a.InfoHash] = append(me.announces[a.InfoHash], Announcer{
+			InfoHash:    a.InfoHash,
+			PeerID:      a.PeerID,
+			IP:          a.IP,
+			Port:        a.Port,
+			ImpliedPort: a.ImpliedPort,
+			CreatedAt:   time.Now(),
+		})
+	}
+	if t, ok := me.torrents[a.InfoHash]; ok {
+		if !repeat {
+			t.AnnounceCount++
+		}
+		t.RawAnnounceCount++
+		t.lookupOnly = false
+	}
+	u := time.Now().Unix()
+	me.announceHours[memAnnounceBucket{a.InfoHash, u - u%3600}]++
+}
+
+func (me *MemoryStore) CreateLookup(hash string, nodeID string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.createLookup(hash)
+	return nil
+}
+
+func (me *MemoryStore) createLookup(hash string) {
+	me.lookups[hash] = append(me.lookups[hash], time.Now())
+	if t, ok := me.torrents[hash]; ok {
+		t.LookupCount++
+	}
+}
+
+// WriteBatch stores every announce, lookup and queued hash in b.
+func (me *MemoryStore) WriteBatch(b IngestBatch) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, a := range b.Announces {
+		me.createTorrent(a.InfoHash)
+		me.createAnnounce(a)
+	}
+	for _, l := range b.Lookups {
+		if _, ok := me.torrents[l.InfoHash]; !ok {
+			me.createTorrent(l.InfoHash)
+			me.torrents[l.InfoHash].lookupOnly = true
+		}
+		me.createLookup(l.InfoHash)
+	}
+	for _, h := range b.Queue {
+		me.createTorrent(h)
+		me.enqueueHash(h)
+	}
+	return nil
+}
+
+// EnqueueHash adds hash to the resolve queue unless it is resolved or dead.
+// If hash is already queued it is marked as seen now.
+func (me *MemoryStore) EnqueueHash(hash string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.enqueueHash(hash)
+	return nil
+}
+
+func (me *MemoryStore) enqueueHash(hash string) {
+	if t, ok := me.torrents[hash]; ok {
+		t.lookupOnly = false
+		if (!t.ResolvedAt.IsZero() && !t.FilesStale) || t.Dead {
+			return
+		}
+	}
+	q, ok := me.queue[hash]
+	if !ok {
+		q = &memQueued{}
+		me.queue[hash] = q
+	}
+	q.seenAt = time.Now()
+}
+
+// waiting returns the queued hashes that aren't started, highest priority
+// first.
+func (me *MemoryStore) waiting() []string {
+	ret := make([]string, 0)
+	for h, q := range me.queue {
+		if !q.started {
+			ret = append(ret, h)
+		}
+	}
+	announces := func(h string) int {
+		if t, ok := me.torrents[h]; ok {
+			return t.AnnounceCount
+		}
+		return 0
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		ai, aj := announces(ret[i]), announces(ret[j])
+		if ai != aj {
+			return ai > aj
+		}
+		return me.queue[ret[i]].seenAt.After(me.queue[ret[j]].seenAt)
+	})
+	return ret
+}
+
+// DequeueHashes returns up to limit of the highest priority queued hashes
+// and marks them started.
+func (me *MemoryStore) DequeueHashes(limit int) ([]string, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret := make([]string, 0)
+	now := time.Now()
+	for _, h := range me.waiting() {
+		if len(ret) >= limit {
+			break
+		}
+		if t, ok := me.torrents[h]; ok && t.retryAt.After(now) {
+			continue
+		}
+		me.queue[h].started = true
+		ret = append(ret, h)
+	}
+	return ret, nil
+}
+
+// FinishHash removes hash from the resolve queue.
+func (me *MemoryStore) FinishHash(hash string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	delete(me.queue, hash)
+	return nil
+}
+
+// ResetResolveQueue returns started hashes to the queue.
+func (me *MemoryStore) ResetResolveQueue() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, q := range me.queue {
+		q.started = false
+	}
+	return nil
+}
+
+// TrimResolveQueue drops the lowest priority hashes that aren't started so
+// that at most max remain waiting. It returns the number dropped.
+func (me *MemoryStore) TrimResolveQueue(max int) (int64, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	hs := me.waiting()
+	if len(hs) <= max {
+		return 0, nil
+	}
+	for _, h := range hs[max:] {
+		delete(me.queue, h)
+	}
+	return int64(len(hs) - max), nil
+}
+
+// ResolveQueueDepth returns the number of hashes in the resolve queue.
+func (me *MemoryStore) ResolveQueueDepth() (int64, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return int64(len(me.queue)), nil
+}
+
+// RecordResolveFailure counts a failed attempt to resolve hash.
+func (me *MemoryStore) RecordResolveFailure(hash string, reason string, retryAt time.Time, dead bool) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if t, ok := me.torrents[hash]; ok {
+		t.ResolveAttempts++
+		t.LastAttemptAt = time.Now()
+		t.LastFailure = reason
+		t.retryAt = retryAt
+		t.Dead = dead
+	}
+	return nil
+}
+
+// RecordResolveHint counts a resolve attempt of hash that was given
+// announcer endpoints as initial peers.
+func (me *MemoryStore) RecordResolveHint(hash string, resolved bool) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if t, ok := me.torrents[hash]; ok {
+		t.hintedAttempts++
+		if resolved {
+			t.resolvedWithHint++
+		}
+	}
+	return nil
+}
+
+func (me *MemoryStore) SetTorrentMeta(hash string, m TorrentMeta) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	t, ok := me.torrents[hash]
+	if !ok {
+		return nil
+	}
+	m.Release = ParseRelease(m.Name)
+	now := time.Now()
+	t.TorrentMeta = m
+	t.ResolvedAt = now
+	t.ResolveAttempts++
+	t.LastAttemptAt = now
+	t.LastFailure = ""
+	t.retryAt = time.Time{}
+	t.Dead = false
+	t.FilesStale = false
+	return nil
+}
+
+// SetTorrentInfo stores the bencoded info dictionary of a resolved torrent.
+func (me *MemoryStore) SetTorrentInfo(hash string, info []byte) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.infos[hash] = info
+	return nil
+}
+
+// memSearch is a name indexed for search and the index of the file it
+// names, or -1.
+type memSearch struct {
+	name string
+	file int
+}
+
+func (me *MemoryStore) CreateTorrentSearch(hash string, name string, file int) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, s := range me.search[hash] {
+		if s.name == name {
+			return nil
+		}
+	}
+	me.search[hash] = append(me.search[hash], memSearch{name, file})
+	return nil
+}
+
+// DeleteTorrentSearch removes the names of hash from search.
+func (me *MemoryStore) DeleteTorrentSearch(hash string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	delete(me.search, hash)
+	return nil
+}
+
+func (me *MemoryStore) CreateFileInfo(hash string, path string, length int64, index int) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.files[hash] = append(me.files[hash], FileInfo{path, length, index, hash})
+	return nil
+}
+
+// DeleteFileInfo removes the stored files of hash.
+func (me *MemoryStore) DeleteFileInfo(hash string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	delete(me.files, hash)
+	return nil
+}
+
+// AddTrackers records announce URLs listed in the metadata of hash.
+func (me *MemoryStore) AddTrackers(hash string, urls []string) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, u := range urls {
+		known := false
+		for _, o := range me.trackers[hash] {
+			known = known || o == u
+		}
+		if !known {
+			me.trackers[hash] = append(me.trackers[hash], u)
+		}
+	}
+	return nil
+}
+
+func (me *MemoryStore) GetTorrent(hash string) (Torrent, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	t, ok := me.torrents[hash]
+	if !ok {
+		return Torrent{}, sql.ErrNoRows
+	}
+	return t.Torrent, nil
+}
+
+// GetTorrentInfo returns the bencoded info dictionary stored for hash, or
+// sql.ErrNoRows if there is none.
+func (me *MemoryStore) GetTorrentInfo(hash string) ([]byte, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	info, ok := me.infos[hash]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return info, nil
+}
+
+func (me *MemoryStore) GetFileInfo(hash string) ([]*FileInfo, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret := make([]*FileInfo, 0, len(me.files[hash]))
+	for _, f := range me.files[hash] {
+		f := f
+		ret = append(ret, &f)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Index < ret[j].Index })
+	return ret, nil
+}
+
+// GetAnnouncers returns every distinct node that has announced hash, most
+// recent first.
+func (me *MemoryStore) GetAnnouncers(hash string) ([]Announcer, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret := append([]Announcer{}, me.announces[hash]...)
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].CreatedAt.After(ret[j].CreatedAt) })
+	return ret, nil
+}
+
+// GetTrackers returns the announce URLs recorded for hash.
+func (me *MemoryStore) GetTrackers(hash string) ([]string, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return append([]string{}, me.trackers[hash]...), nil
+}
+
+// selectTorrents returns up to limit torrents matching keep, highest score
+// first.
+func (me *MemoryStore) selectTorrents(limit int, keep func(*memTorrent) bool, score func(Torrent) int) []Torrent {
+	ret := make([]Torrent, 0)
+	for _, t := range me.torrents {
+		if keep(t) {
+			ret = append(ret, t.Torrent)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		si, sj := score(ret[i]), score(ret[j])
+		if si != sj {
+			return si > sj
+		}
+		return ret[i].InfoHash < ret[j].InfoHash
+	})
+	if limit >= 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret
+}
+
+func rankScore(mode RankMode, counter AnnounceCounter) func(Torrent) int {
+	return func(t Torrent) int {
+		return t.Rank(mode, counter)
+	}
+}
+
+// PopularTorrents returns the top limit torrents matching filter ranked by
+// mode. Torrents marked dead are left out unless includeDead is set.
+func (me *MemoryStore) PopularTorrents(limit int, mode RankMode, counter AnnounceCounter, filter SearchFilter, includeDead bool) ([]Torrent, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	keep := func(t *memTorrent) bool {
+		return (includeDead || !t.Dead) && me.matchFilter(t, filter, counter)
+	}
+	return me.selectTorrents(limit, keep, rankScore(mode, counter)), nil
+}
+
+// TimelineTorrents returns the last buckets buckets of the given
+// granularity up to now, newest first, each with up to limit torrents
+// matching filter ranked by their activity in the bucket, counting
+// announces with counter.
+func (me *MemoryStore) TimelineTorrents(buckets int, granularity Granularity, limit int, mode RankMode, counter AnnounceCounter, filter SearchFilter) ([]TimelineEntry, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret, last := timelineBuckets(time.Now(), buckets, granularity)
+	size := granularity.seconds()
+	counts := make([]map[string]int, len(ret))
+	add := func(h string, seen int64, n int) {
+		i := last - (seen-timelineOrigin)/size
+		if seen < timelineOrigin || i < 0 || i >= int64(len(ret)) {
+			return
+		}
+		if counts[i] == nil {
+			counts[i] = make(map[string]int)
+		}
+		counts[i][h] += n
+	}
+	if mode != RankDemand && counter == CountRaw {
+		for b, n := range me.announceHours {
+			add(b.hash, b.start+hourMidpoint, n)
+		}
+		for d, c := range me.announceDays {
+			add(d.hash, d.start+rollupMidday, c.announces)
+		}
+	} else if mode != RankDemand {
+		for h, as := range me.announces {
+			for _, a := range as {
+				add(h, a.CreatedAt.Unix(), 1)
+			}
+		}
+		for d, c := range me.announceDays {
+			add(d.hash, d.start+rollupMidday, c.announcers)
+		}
+	}
+	if mode == RankDemand || mode == RankCombined {
+		for h, ls := range me.lookups {
+			for _, l := range ls {
+				add(h, l.Unix(), 1)
+			}
+		}
+	}
+	for i, c := range counts {
+		ts := make([]TimelineTorrent, 0)
+		for h, n := range c {
+			t, ok := me.torrents[h]
+			if ok && me.matchFilter(t, filter, counter) {
+				ts = append(ts, TimelineTorrent{t.Torrent, n})
+			}
+		}
+		score := func(t TimelineTorrent) int {
+			if mode == RankSwarm {
+				return t.Swarm.Size()
+			}
+			return t.Count
+		}
+		sort.Slice(ts, func(i, j int) bool {
+			if score(ts[i]) != score(ts[j]) {
+				return score(ts[i]) > score(ts[j])
+			}
+			return ts[i].InfoHash < ts[j].InfoHash
+		})
+		if len(ts) > limit {
+			ts = ts[:limit]
+		}
+		ret[i].Torrents = ts
+	}
+	return ret, nil
+}
+
+// SearchTorrents returns up to limit torrents with a name or file path
+// containing every word and phrase of term, ranked by order. Matches are
+// scored with bm25 like the SQLite full text search, and the fields of term
+// filter on the torrent metadata.
+func (me *MemoryStore) SearchTorrents(term string, limit int, order SearchOrder, counter AnnounceCounter, filter SearchFilter) ([]SearchResult, error) {
+	qw, err := parseQuery(term, &filter)
+	if err != nil {
+		return nil, err
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret := make([]SearchResult, 0)
+	terms := parseQueryTerms(qw)
+	words := termWords(terms)
+	if len(terms) == 0 {
+		keep := func(t *memTorrent) bool {
+			return !t.ResolvedAt.IsZero() && me.matchFilter(t, filter, counter)
+		}
+		for _, t := range me.selectTorrents(limit, keep, rankScore(RankSupply, counter)) {
+			ret = append(ret, SearchResult{Torrent: t})
+		}
+		return ret, nil
+	}
+	docs := make([][]string, 0)
+	for _, names := range me.search {
+		for _, s := range names {
+			docs = append(docs, searchTokens(s.name))
+		}
+	}
+	score := bm25(docs, words)
+	best := make(map[string]SearchResult)
+	for h, names := range me.search {
+		t, ok := me.torrents[h]
+		if !ok || !me.matchFilter(t, filter, counter) {
+			continue
+		}
+		for _, s := range names {
+			tokens := searchTokens(s.name)
+			if !matchTerms(tokens, terms) {
+				continue
+			}
+			rel := score(tokens)
+			if r, ok := best[h]; !ok || rel > r.Relevance {
+				best[h] = SearchResult{t.Torrent, rel, snippet(s.name, words), me.file(h, s.file)}
+			}
+		}
+	}
+	for _, r := range best {
+		ret = append(ret, r)
+	}
+	return sortResults(ret, limit, order, counter), nil
+}
+
+// file returns the file of hash at index, or nil if it isn't stored.
+func (me *MemoryStore) file(hash string, index int) *FileInfo {
+	for _, fi := range me.files[hash] {
+		if fi.Index == index {
+			return &fi
+		}
+	}
+	return nil
+}
+
+// matchFilter reports if t passes f, including the conditions on its files
+// and search names.
+func (me *MemoryStore) matchFilter(t *memTorrent, f SearchFilter, c AnnounceCounter) bool {
+	if !f.match(t.Torrent, c) {
+		return false
+	}
+	if len(f.Extensions) > 0 {
+		paths := make([]string, len(me.files[t.InfoHash]))
+		for i, fi := range me.files[t.InfoHash] {
+			paths[i] = fi.Path
+		}
+		if !f.matchFiles(paths) {
+			return false
+		}
+	}
+	if len(f.Exclude) > 0 {
+		names := make([]string, len(me.search[t.InfoHash]))
+		for i, s := range me.search[t.InfoHash] {
+			names[i] = s.name
+		}
+		if !f.matchNames(names) {
+			return false
+		}
+	}
+	return true
+}
+
+// TrendingTorrents returns the top limit torrents matching filter by their
+// announces in the last window, ranked by view.
+func (me *MemoryStore) TrendingTorrents(window time.Duration, limit int, view TrendView, filter SearchFilter) ([]TrendingTorrent, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	w := newTrendWindow(time.Now(), window)
+	byHash := make(map[string]*trendCounts)
+	add := func(h string, seen int64, n int) {
+		if seen <= w.prev {
+			return
+		}
+		c, ok := byHash[h]
+		if !ok {
+			c = &trendCounts{}
+			byHash[h] = c
+		}
+		w.add(c, seen, n)
+	}
+	for b, n := range me.announceHours {
+		add(b.hash, b.start+hourMidpoint, n)
+	}
+	for d, c := range me.announceDays {
+		add(d.hash, d.start+rollupMidday, c.announces)
+	}
+	ret := make([]TrendingTorrent, 0)
+	for h, c := range byHash {
+		t, ok := me.torrents[h]
+		if !ok || !me.matchFilter(t, filter, CountDistinct) {
+			continue
+		}
+		if tt, ok := c.trending(t.Torrent, view); ok {
+			ret = append(ret, tt)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Score != ret[j].Score {
+			return ret[i].Score > ret[j].Score
+		}
+		return ret[i].InfoHash < ret[j].InfoHash
+	})
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
+
+// AnnounceHistory returns the announces of hash in the last buckets buckets
+// of the given granularity up to now, oldest first. Announces are counted in
+// the middle of their hour, and rolled up announces in the middle of their
+// day.
+func (me *MemoryStore) AnnounceHistory(hash string, buckets int, granularity Granularity) ([]HistoryBucket, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret, first := historyBuckets(time.Now(), buckets, granularity)
+	size := granularity.seconds()
+	add := func(seen int64, announces int, announcers int) {
+		i := (seen-timelineOrigin)/size - first
+		if seen < timelineOrigin || i < 0 || i >= int64(len(ret)) {
+			return
+		}
+		ret[i].Announces += announces
+		ret[i].Announcers += announcers
+	}
+	for _, a := range me.announces[hash] {
+		add(a.CreatedAt.Unix(), 0, 1)
+	}
+	for h, n := range me.announceHours {
+		if h.hash == hash {
+			add(h.start+hourMidpoint, n, 0)
+		}
+	}
+	for d, c := range me.announceDays {
+		if d.hash == hash {
+			add(d.start+rollupMidday, c.announces, c.announcers)
+		}
+	}
+	return ret, nil
+}
+
+// UnresolvedTorrents returns up to limit torrents that have failed to
+// resolve, dead torrents first and then by attempts.
+func (me *MemoryStore) UnresolvedTorrents(limit int, onlyDead bool) ([]Torrent, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ret := make([]Torrent, 0)
+	for _, t := range me.torrents {
+		if t.ResolvedAt.IsZero() && t.ResolveAttempts > 0 && (t.Dead || !onlyDead) {
+			ret = append(ret, t.Torrent)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		if a.Dead != b.Dead {
+			return a.Dead
+		}
+		if a.ResolveAttempts != b.ResolveAttempts {
+			return a.ResolveAttempts > b.ResolveAttempts
+		}
+		return a.AnnounceCount > b.AnnounceCount
+	})
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
+
+func popularityScore(t Torrent) int {
+	return t.AnnounceCount + t.LookupCount
+}
+
+// SwarmSampleCandidates returns up to limit of the most popular resolved
+// torrents that haven't had a swarm sample since before.
+func (me *MemoryStore) SwarmSampleCandidates(before time.Time, limit int) ([]Torrent, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	keep := func(t *memTorrent) bool {
+		return !t.ResolvedAt.IsZero() && !t.Dead && t.Swarm.SampledAt.Before(before) && t.swarmFailedAt.Before(before)
+	}
+	return me.selectTorrents(limit, keep, popularityScore), nil
+}
+
+// RecordSwarmSample makes s the latest swarm estimate of hash.
+func (me *MemoryStore) RecordSwarmSample(hash string, s SwarmSample) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.swarmSamples++
+	if t, ok := me.torrents[hash]; ok {
+		t.Swarm = s
+	}
+	return nil
+}
+
+// RecordSwarmFailure marks a failed swarm sample of hash at, keeping its
+// latest estimate.
+func (me *MemoryStore) RecordSwarmFailure(hash string, at time.Time) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if t, ok := me.torrents[hash]; ok {
+		t.swarmFailedAt = at
+	}
+	return nil
+}
+
+// TrackerScrapeCandidates returns up to limit of the most popular resolved
+// torrents that haven't been scraped since before.
+func (me *MemoryStore) TrackerScrapeCandidates(before time.Time, onlyWithTrackers bool, limit int) ([]string, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	keep := func(t *memTorrent) bool {
+		return !t.ResolvedAt.IsZero() && !t.Dead && t.Tracker.ScrapedAt.Before(before) &&
+			(!onlyWithTrackers || len(me.trackers[t.InfoHash]) > 0)
+	}
+	ret := make([]string, 0)
+	for _, t := range me.selectTorrents(limit, keep, popularityScore) {
+		ret = append(ret, t.InfoHash)
+	}
+	return ret, nil
+}
+
+// RecordTrackerScrapes marks hash scraped at and keeps the scrape with the
+// most seeders as its latest tracker counts.
+func (me *MemoryStore) RecordTrackerScrapes(hash string, at time.Time, scrapes []TrackerScrape) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.scrapes += int64(len(scrapes))
+	t, ok := me.torrents[hash]
+	if !ok {
+		return nil
+	}
+	t.Tracker.ScrapedAt = at
+	if len(scrapes) == 0 {
+		return nil
+	}
+	best := scrapes[0]
+	for _, ts := range scrapes {
+		if ts.Seeders > best.Seeders {
+			best = ts
+		}
+	}
+	t.Tracker.Seeders = best.Seeders
+	t.Tracker.Leechers = best.Leechers
+	t.Tracker.Completed = best.Completed
+	return nil
+}
+
+// RollupAnnounces adds the announces made before before, and their hourly
+// counts, to the daily counts and deletes them, returning how many announces
+// were rolled up. The nodes rolled up are kept, so they aren't counted as
+// new announcers if they announce again.
+func (me *MemoryStore) RollupAnnounces(before time.Time) (int64, error) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	n := int64(0)
+	for h, as := range me.announces {
+		kept := as[:0]
+		for _, a := range as {
+			if !a.CreatedAt.Before(before) {
+				kept = append(kept, a)
+				continue
+			}
+			if me.announceSeen[h] == nil {
+				me.announceSeen[h] = make(map[string]bool)
+			}
+			me.announceSeen[h][a.PeerID] = true
+			u := a.CreatedAt.Unix()
+			d := memAnnounceBucket{h, u - u%86400}
+			c := me.announceDays[d]
+			c.announcers++
+			me.announceDays[d] = c
+			n++
+		}
+		me.announces[h] = kept
+	}
+	for b, count := range me.announceHours {
+		if b.start >= before.Unix() {
+			continue
+		}
+		d := memAnnounceBucket{b.hash, b.start - b.start%86400}
+		c := me.announceDays[d]
+		c.announces += count
+		me.announceDays[d] = c
+		delete(me.announceHours, b)
+	}
+	return n, nil
+}
@@ -0,0 +1,567 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Migration is a versioned change to the database schema. Migrations are
+// applied in order, each in its own transaction, and the versions applied are
+// recorded in the schema_version table.
+type Migration struct {
+	Version     int
+	Description string
+	up          func(tx *sqlTx) error
+}
+
+// sqliteMigrations must be kept in order. Never change a released
+// migration, add a new one instead.
+var sqliteMigrations = []Migration{
+	{1, "Create tables and add columns missing from unversioned databases", migrateBaseline},
+	{2, "Move search_torrent to FTS5", migrateSearchFTS5},
+	{3, "Store each search name once and link it to its file", migrateSearchText},
+	{4, "Add daily announce rollups", migrateAnnounceDaily},
+	{5, "Index lookups by date", migrateLookupCreated},
+	{6, "Mark torrents only seen in lookups", migrateLookupOnly},
+	{7, "Rebuild file lists from stored info dictionaries", migrateFileInfo},
+	{8, "Categorize single-file torrents from their names", recategorizeTorrents},
+	{9, "Count every announce by hour", migrateAnnounceHourly},
+	{10, "Keep the nodes of rolled up announces", migrateAnnounceSeen},
+	{11, "Count resolves with announcer hints", migrateResolveHintCount},
+	{12, "Record failed swarm samples", migrateSwarmFailedAt},
+}
+
+// NewSqliteDB opens the database in filePath and applies any pending
+// migrations.
+func NewSqliteDB(filePath string) (*SqliteDBClient, error) {
+	ret, err := OpenSqliteDB(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err = ret.migrateAll(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// OpenSqliteDB opens the database in filePath without migrating it. It
+// fails if det was built without FTS5, which search and the migrations from
+// schema version 2 need.
+func OpenSqliteDB(filePath string) (*SqliteDBClient, error) {
+	log.Printf("Using SQLite DB: %ssqlite.db", filePath)
+	db, err := sql.Open("sqlite3", filepath.Join(filePath, "sqlite.db"))
+	if err != nil {
+		return nil, err
+	}
+	var fts5 bool
+	if err = db.QueryRow(sqlHasFTS5).Scan(&fts5); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !fts5 {
+		db.Close()
+		return nil, fmt.Errorf("SQLite was built without FTS5, rebuild det with: go build -tags sqlite_fts5")
+	}
+	return &SqliteDBClient{sqlClient{&sqlDB{db, sqliteDialect{}}, sqliteMigrations}}, nil
+}
+
+// migrateAll applies pending migrations, closing the db if they fail.
+func (me *sqlClient) migrateAll() error {
+	applied, err := me.Migrate()
+	for _, m := range applied {
+		log.Printf("Applied migration %d: %s", m.Version, m.Description)
+	}
+	if err != nil {
+		me.db.Close()
+		return err
+	}
+	return nil
+}
+
+// LatestSchemaVersion returns the schema version of this build of det.
+func (me *sqlClient) LatestSchemaVersion() int {
+	return me.migrations[len(me.migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the last migration applied to the
+// database, or 0 for databases created before schema versions.
+func (me *sqlClient) SchemaVersion() (int, error) {
+	var n int
+	err := me.db.QueryRow(sqlHasSchemaVersion).Scan(&n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	var v int
+	err = me.db.QueryRow(sqlSchemaVersion).Scan(&v)
+	return v, err
+}
+
+// PendingMigrations returns the migrations not yet applied to the database.
+// It fails if the database was migrated by a newer det.
+func (me *sqlClient) PendingMigrations() ([]Migration, error) {
+	v, err := me.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if latest := me.LatestSchemaVersion(); v > latest {
+		return nil, fmt.Errorf("Database schema version %d is newer than this det supports (%d), please upgrade", v, latest)
+	}
+	ret := make([]Migration, 0)
+	for _, m := range me.migrations {
+		if m.Version > v {
+			ret = append(ret, m)
+		}
+	}
+	return ret, nil
+}
+
+// Migrate applies pending migrations and returns them.
+func (me *sqlClient) Migrate() ([]Migration, error) {
+	pending, err := me.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 {
+		return pending, nil
+	}
+	if _, err = me.db.Exec(sqlCreateSchemaVersionTable); err != nil {
+		return nil, err
+	}
+	for i, m := range pending {
+		if err = me.migrate(m); err != nil {
+			return pending[:i], fmt.Errorf("Migration %d (%s): %s", m.Version, m.Description, err)
+		}
+	}
+	return pending, nil
+}
+
+func (me *sqlClient) migrate(m Migration) error {
+	tx, err := me.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = m.up(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec(sqlRecordSchemaVersion, m.Version, m.Description); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateBaseline creates the schema as it was when schema versions were
+// introduced. Databases created before then are brought up to date by
+// adding the columns they are missing.
+func migrateBaseline(tx *sqlTx) error {
+	stmts := []string{
+		sqlCreateTorrentTable,
+		sqlCreateFileInfoTable,
+		sqlCreateTorrentInfoTable,
+		sqlCreateSwarmSampleTable,
+		sqlCreateSwarmSampleIndex,
+		sqlCreateTorrentTrackerTable,
+		sqlCreateTrackerScrapeTable,
+		sqlCreateTrackerScrapeIndex,
+		sqlCreateSearchTable,
+		sqlCreateAnnounceTable,
+		sqlCreateLookupTable,
+		sqlCreateResolveQueueTable,
+	}
+	for _, q := range stmts {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return addColumns(tx)
+}
+
+// migrateSearchFTS5 copies search_torrent to an FTS5 table, which det
+// needs for bm25 ranking and snippets.
+func migrateSearchFTS5(tx *sqlTx) error {
+	stmts := []string{
+		sqlRenameFTS4SearchTable,
+		sqlCreateFTS5SearchTable,
+		sqlCopyFTS4SearchTable,
+		sqlDropFTS4SearchTable,
+	}
+	for _, q := range stmts {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSearchText moves the names in search_torrent to search_text,
+// dropping duplicates and linking file paths to their file_info rows, and
+// indexes them with an external content FTS5 table.
+func migrateSearchText(tx *sqlTx) error {
+	stmts := []string{
+		sqlCreateFileInfoIndex,
+		sqlCreateSearchTextTable,
+		sqlCopySearchText,
+		sqlDropSearchTable,
+		sqlCreateSearchTextIndex,
+		sqlRebuildSearchTextIndex,
+		sqlCreateSearchTextInsertTrigger,
+		sqlCreateSearchTextDeleteTrigger,
+	}
+	for _, q := range stmts {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateAnnounceDaily adds the table RollupAnnounces moves old announces
+// to, and indexes announces by date to find them.
+func migrateAnnounceDaily(tx *sqlTx) error {
+	for _, q := range []string{sqlCreateAnnounceDailyTable, sqlCreateAnnounceCreatedIndex} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateAnnounceHourly adds the hourly announce counts and fills them from
+// the stored announces.
+func migrateAnnounceHourly(tx *sqlTx) error {
+	for _, q := range []string{sqlCreateAnnounceHourlyTable, sqlBackfillAnnounceHourly} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateAnnounceSeen adds the table of nodes whose announces were rolled
+// up. Those rolled up before it can't be recovered.
+func migrateAnnounceSeen(tx *sqlTx) error {
+	_, err := tx.Exec(sqlCreateAnnounceSeenTable)
+	return err
+}
+
+// migrateResolveHintCount makes resolved_with_hint a count of hinted
+// resolves. A torrent flagged as resolved by its last hinted attempt is
+// counted once, and a cleared or missing flag as none.
+func migrateResolveHintCount(tx *sqlTx) error {
+	_, err := tx.Exec(sqlCountResolveHints)
+	return err
+}
+
+// migrateSwarmFailedAt adds swarm_failed_at.
+func migrateSwarmFailedAt(tx *sqlTx) error {
+	_, err := tx.Exec(sqlAddSwarmFailedAt)
+	return err
+}
+
+// migrateLookupCreated indexes lookups by date for timelines.
+func migrateLookupCreated(tx *sqlTx) error {
+	_, err := tx.Exec(sqlCreateLookupCreatedIndex)
+	return err
+}
+
+// migrateLookupOnly adds lookup_only and marks the torrents that were only
+// looked up.
+func migrateLookupOnly(tx *sqlTx) error {
+	for _, q := range []string{sqlAddLookupOnly, sqlBackfillLookupOnly} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateFileInfo rebuilds the files and search names of torrents resolved
+// before file paths were stored whole, which stored a row per path
+// component. Torrents without a stored info dictionary, or whose dictionary
+// doesn't decode, are marked stale and queued to be resolved again.
+func migrateFileInfo(tx *sqlTx) error {
+	if _, err := tx.Exec(sqlAddFilesStale); err != nil {
+		return err
+	}
+	rows, err := tx.Query(sqlStoredInfoHashes)
+	if err != nil {
+		return err
+	}
+	hashes := make([]string, 0)
+	for rows.Next() {
+		var h string
+		if err = rows.Scan(&h); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes = append(hashes, h)
+	}
+	rows.Close()
+	for _, h := range hashes {
+		var b []byte
+		if err = tx.QueryRow(sqlGetTorrentInfo, h).Scan(&b); err != nil {
+			return err
+		}
+		var info metainfo.Info
+		if bencode.Unmarshal(b, &info) != nil {
+			if _, err = tx.Exec(sqlSetFilesStale, h); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = rebuildFileInfo(tx, h, &info); err != nil {
+			return err
+		}
+	}
+	for _, q := range []string{sqlMarkFilesStale, sqlEnqueueFilesStale} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildFileInfo replaces the files and search names of hash with those of
+// info.
+func rebuildFileInfo(tx *sqlTx, hash string, info *metainfo.Info) error {
+	for _, q := range []string{sqlDeleteFileInfo, sqlDeleteTorrentSearch} {
+		if _, err := tx.Exec(q, hash); err != nil {
+			return err
+		}
+	}
+	var nameFile interface{}
+	if len(info.Files) == 0 {
+		nameFile = 0
+	}
+	if _, err := tx.Exec(sqlCreateTorrentSearch, hash, info.Name, nameFile); err != nil {
+		return err
+	}
+	for _, fi := range infoFiles(info) {
+		if _, err := tx.Exec(sqlCreateFileInfo, hash, fi.Path, fi.Length, fi.Index); err != nil {
+			return err
+		}
+		if len(info.Files) > 0 {
+			if _, err := tx.Exec(sqlCreateTorrentSearch, hash, fi.Path, fi.Index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tableColumn is a column that was added to a table before schema versions
+// were introduced. If backfill is set it is run once, right after the column is
+// added.
+type tableColumn struct {
+	table    string
+	name     string
+	def      string
+	backfill func(tx *sqlTx) error
+}
+
+// execBackfill returns a backfill that runs the statement q.
+func execBackfill(q string) func(tx *sqlTx) error {
+	return func(tx *sqlTx) error {
+		_, err := tx.Exec(q)
+		return err
+	}
+}
+
+var addedColumns = []tableColumn{
+	{"torrent", "lookup_count", "INTEGER DEFAULT 0", nil},
+	{"announce", "ip", "TEXT DEFAULT NULL", nil},
+	{"announce", "port", "INTEGER DEFAULT 0", nil},
+	{"announce", "implied_port", "INTEGER DEFAULT 0", nil},
+	{"torrent", "resolve_attempts", "INTEGER DEFAULT 0", nil},
+	{"torrent", "last_attempt_at", "DATE DEFAULT NULL", nil},
+	{"torrent", "last_failure", "TEXT DEFAULT NULL", nil},
+	{"torrent", "retry_at", "DATE DEFAULT NULL", nil},
+	{"torrent", "dead", "INTEGER DEFAULT 0", nil},
+	{"torrent", "hinted_attempts", "INTEGER DEFAULT 0", nil},
+	{"torrent", "resolved_with_hint", "INTEGER DEFAULT 0", nil},
+	{"torrent", "raw_announce_count", "INTEGER DEFAULT 0", execBackfill(sqlRecountAnnounces)},
+	{"torrent", "piece_length", "INTEGER DEFAULT 0", nil},
+	{"torrent", "file_count", "INTEGER DEFAULT 0", nil},
+	{"torrent", "private", "INTEGER DEFAULT 0", nil},
+	{"torrent", "source", "TEXT DEFAULT NULL", nil},
+	{"torrent", "creation_date", "DATE DEFAULT NULL", nil},
+	{"torrent", "comment", "TEXT DEFAULT NULL", nil},
+	{"torrent", "created_by", "TEXT DEFAULT NULL", nil},
+	{"torrent", "category", "TEXT DEFAULT NULL", nil},
+	{"torrent", "category_confidence", "REAL DEFAULT 0", categorizeTorrents},
+	{"torrent", "title", "TEXT DEFAULT NULL", nil},
+	{"torrent", "year", "INTEGER DEFAULT 0", nil},
+	{"torrent", "season", "INTEGER DEFAULT 0", nil},
+	{"torrent", "episode", "INTEGER DEFAULT 0", nil},
+	{"torrent", "resolution", "TEXT DEFAULT NULL", nil},
+	{"torrent", "codec", "TEXT DEFAULT NULL", nil},
+	{"torrent", "release_source", "TEXT DEFAULT NULL", nil},
+	{"torrent", "release_group", "TEXT DEFAULT NULL", parseReleases},
+	{"torrent", "swarm_sampled_at", "DATE DEFAULT NULL", nil},
+	{"torrent", "swarm_peers", "INTEGER DEFAULT 0", nil},
+	{"torrent", "swarm_seeders", "INTEGER DEFAULT NULL", nil},
+	{"torrent", "swarm_leechers", "INTEGER DEFAULT NULL", nil},
+	{"torrent", "swarm_size", "INTEGER DEFAULT 0", nil},
+	{"torrent", "tracker_scraped_at", "DATE DEFAULT NULL", nil},
+	{"torrent", "tracker_seeders", "INTEGER DEFAULT 0", nil},
+	{"torrent", "tracker_leechers", "INTEGER DEFAULT 0", nil},
+	{"torrent", "tracker_completed", "INTEGER DEFAULT 0", nil},
+}
+
+// addColumns brings databases created by versions of det without schema
+// versions up to date by adding any missing columns to their tables.
+func addColumns(tx *sqlTx) error {
+	for _, c := range addedColumns {
+		exists, err := hasColumn(tx, c.table, c.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		log.Printf("Adding column %s.%s", c.table, c.name)
+		_, err = tx.Exec(fmt.Sprintf(sqlAddColumn, c.table, c.name, c.def))
+		if err != nil {
+			return err
+		}
+		if c.backfill != nil {
+			log.Printf("Backfilling column %s.%s", c.table, c.name)
+			err = c.backfill(tx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasColumn(tx *sqlTx, table string, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf(sqlTableColumns, table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt *string
+		err = rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk)
+		if err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// categorizeTorrents classifies resolved torrents that don't have a category
+// yet from their files.
+func categorizeTorrents(tx *sqlTx) error {
+	rows, err := tx.Query(sqlUncategorizedTorrents)
+	if err != nil {
+		return err
+	}
+	torrents := make([]FileInfo, 0)
+	for rows.Next() {
+		var t FileInfo
+		var n *string
+		if err = rows.Scan(&t.InfoHash, &n, &t.Length); err != nil {
+			rows.Close()
+			return err
+		}
+		if n != nil {
+			t.Path = *n
+		}
+		torrents = append(torrents, t)
+	}
+	rows.Close()
+	for _, t := range torrents {
+		files, err := storedFiles(tx, t)
+		if err != nil {
+			return err
+		}
+		c, conf := Classify(files)
+		_, err = tx.Exec(sqlSetCategory, string(c), conf, t.InfoHash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedFiles returns the files of the resolved torrent t, given as its
+// name and total length. They are taken from its info dictionary if it is
+// stored and decodes, else from file_info. Single-file torrents were stored
+// without file_info rows by older versions of det, and are their name.
+func storedFiles(tx *sqlTx, t FileInfo) ([]FileInfo, error) {
+	var b []byte
+	err := tx.QueryRow(sqlGetTorrentInfo, t.InfoHash).Scan(&b)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	var info metainfo.Info
+	if err == nil && bencode.Unmarshal(b, &info) == nil {
+		return infoFiles(&info), nil
+	}
+	fis, err := getFileInfo(tx, t.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	if len(fis) == 0 {
+		return []FileInfo{t}, nil
+	}
+	files := make([]FileInfo, len(fis))
+	for i, fi := range fis {
+		files[i] = *fi
+	}
+	return files, nil
+}
+
+// recategorizeTorrents classifies again the torrents categorized without
+// any files that vote, which includes every single-file torrent
+// categorized when the category column was added.
+func recategorizeTorrents(tx *sqlTx) error {
+	if _, err := tx.Exec(sqlResetEmptyCategories, string(CategoryOther)); err != nil {
+		return err
+	}
+	return categorizeTorrents(tx)
+}
+
+// parseReleases parses the release fields of every resolved torrent's name.
+func parseReleases(tx *sqlTx) error {
+	rows, err := tx.Query(sqlResolvedNames)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string)
+	for rows.Next() {
+		var h string
+		var n *string
+		if err = rows.Scan(&h, &n); err != nil {
+			rows.Close()
+			return err
+		}
+		if n != nil {
+			names[h] = *n
+		}
+	}
+	rows.Close()
+	for h, n := range names {
+		r := ParseRelease(n)
+		_, err = tx.Exec(sqlSetRelease, nullString(r.Title), r.Year, r.Season, r.Episode,
+			nullString(r.Resolution), nullString(r.Codec), nullString(r.Source), nullString(r.Group), h)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	// Registers the postgres database/sql driver.
+	_ "github.com/lib/pq"
+)
+
+// PostgresDBClient is a Store in a Postgres database, for det nodes sharing
+// an index.
+type PostgresDBClient struct {
+	sqlClient
+}
+
+// postgresMigrations must be kept in order. Never change a released
+// migration, add a new one instead.
+var postgresMigrations = []Migration{
+	{1, "Create tables", migratePostgresBaseline},
+	{2, "Store each search name once and link it to its file", migratePostgresSearchNames},
+	{3, "Add daily announce rollups", migrateAnnounceDaily},
+	{4, "Index lookups by date", migrateLookupCreated},
+	{5, "Mark torrents only seen in lookups", migrateLookupOnly},
+	{6, "Rebuild file lists from stored info dictionaries", migrateFileInfo},
+	{7, "Categorize single-file torrents from their names", recategorizeTorrents},
+	{8, "Count every announce by hour", migrateAnnounceHourly},
+	{9, "Keep the nodes of rolled up announces", migrateAnnounceSeen},
+	{10, "Count resolves with announcer hints", migrateResolveHintCount},
+	{11, "Record failed swarm samples", migrateSwarmFailedAt},
+}
+
+// NewPostgresDB connects to the database at url, a Postgres connection
+// string, and applies any pending migrations.
+func NewPostgresDB(url string) (*PostgresDBClient, error) {
+	ret, err := OpenPostgresDB(url)
+	if err != nil {
+		return nil, err
+	}
+	if err = ret.migrateAll(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// OpenPostgresDB connects to the database at url without migrating it.
+func OpenPostgresDB(url string) (*PostgresDBClient, error) {
+	if url == "" {
+		return nil, fmt.Errorf("Missing PostgresURL")
+	}
+	log.Printf("Using Postgres DB")
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresDBClient{sqlClient{&sqlDB{db, &postgresDialect{}}, postgresMigrations}}, nil
+}
+
+func migratePostgresBaseline(tx *sqlTx) error {
+	stmts := []string{
+		pgCreateTorrentTable,
+		pgCreateFileInfoTable,
+		pgCreateFileInfoIndex,
+		pgCreateTorrentInfoTable,
+		pgCreateSwarmSampleTable,
+		sqlCreateSwarmSampleIndex,
+		pgCreateTorrentTrackerTable,
+		pgCreateTrackerScrapeTable,
+		sqlCreateTrackerScrapeIndex,
+		pgCreateSearchTable,
+		pgCreateSearchIndex,
+		pgCreateAnnounceTable,
+		pgCreateLookupTable,
+		pgCreateResolveQueueTable,
+	}
+	for _, q := range stmts {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migratePostgresSearchNames drops duplicate names in search_torrent and
+// links file paths to their file_info rows.
+func migratePostgresSearchNames(tx *sqlTx) error {
+	stmts := []string{
+		pgAddSearchPosition,
+		pgDeleteDuplicateSearchNames,
+		pgLinkSearchFiles,
+		pgCreateSearchNameIndex,
+	}
+	for _, q := range stmts {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postgresReplacer translates the SQLite specific parts of queries.
+var postgresReplacer = strings.NewReplacer(
+	"strftime('%s', 'now')", "extract(epoch from now())::bigint",
+	"LIMIT -1 OFFSET ?", "OFFSET ?",
+	"ORDER BY rowid", "ORDER BY id",
+	"WHERE search_torrent MATCH ?", "WHERE to_tsvector('simple', name) @@ plainto_tsquery('simple', ?)",
+)
+
+// postgresDialect translates queries from postgresQueries or with
+// postgresReplacer, and numbers their ? placeholders. Translations are
+// cached.
+type postgresDialect struct {
+	cache sync.Map
+}
+
+func (me *postgresDialect) template(q string) string {
+	if pq, ok := postgresQueries[q]; ok {
+		return pq
+	}
+	return postgresReplacer.Replace(q)
+}
+
+func (me *postgresDialect) query(q string) string {
+	if pq, ok := me.cache.Load(q); ok {
+		return pq.(string)
+	}
+	pq := numberPlaceholders(me.template(q))
+	me.cache.Store(q, pq)
+	return pq
+}
+
+// args stores booleans as integers.
+func (me *postgresDialect) args(args []interface{}) []interface{} {
+	ret := make([]interface{}, len(args))
+	for i, a := range args {
+		if b, ok := a.(bool); ok {
+			a = 0
+			if b {
+				a = 1
+			}
+		}
+		ret[i] = a
+	}
+	return ret
+}
+
+// numberPlaceholders replaces the ? placeholders in q with $1, $2...
+func numberPlaceholders(q string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
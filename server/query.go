@@ -0,0 +1,245 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// queryFields are the fields accepted in search queries, e.g.
+// "ubuntu size:>1GB ext:iso after:2019-06-01 announces:>10 -beta".
+var queryFields = map[string]bool{
+	"year": true, "res": true, "s": true, "e": true, "codec": true, "src": true, "group": true,
+	"size": true, "announces": true, "ext": true, "after": true, "before": true,
+}
+
+// queryDateLayout is the date format of the after: and before: fields.
+const queryDateLayout = "2006-01-02"
+
+// sizeUnits are the multipliers of the units accepted by size:.
+var sizeUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1e3, "kb": 1e3, "m": 1e6, "mb": 1e6, "g": 1e9, "gb": 1e9, "t": 1e12, "tb": 1e12,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40,
+}
+
+// Range is an inclusive range of values. Bounds that aren't set are open.
+type Range struct {
+	Min, Max       int64
+	HasMin, HasMax bool
+}
+
+// AtLeast raises the lower bound of r to n.
+func (r *Range) AtLeast(n int64) {
+	if !r.HasMin || n > r.Min {
+		r.Min, r.HasMin = n, true
+	}
+}
+
+// AtMost lowers the upper bound of r to n.
+func (r *Range) AtMost(n int64) {
+	if !r.HasMax || n < r.Max {
+		r.Max, r.HasMax = n, true
+	}
+}
+
+func (r Range) contains(n int64) bool {
+	return (!r.HasMin || n >= r.Min) && (!r.HasMax || n <= r.Max)
+}
+
+// where appends the conditions keeping col within r.
+func (r Range) where(col string, conds []string, args []interface{}) ([]string, []interface{}) {
+	if r.HasMin {
+		conds = append(conds, col+" >= ?")
+		args = append(args, r.Min)
+	}
+	if r.HasMax {
+		conds = append(conds, col+" <= ?")
+		args = append(args, r.Max)
+	}
+	return conds, args
+}
+
+// narrow applies the comparison op n to r. No op means equal.
+func (r *Range) narrow(op string, n int64) {
+	switch op {
+	case ">":
+		r.AtLeast(n + 1)
+	case ">=":
+		r.AtLeast(n)
+	case "<":
+		r.AtMost(n - 1)
+	case "<=":
+		r.AtMost(n)
+	default:
+		r.AtLeast(n)
+		r.AtMost(n)
+	}
+}
+
+// queryToken is a whitespace separated part of a search query. Quotes group
+// words into one token and are removed.
+type queryToken struct {
+	text    string
+	quoted  bool
+	exclude bool
+}
+
+// splitQuery splits s into tokens. A leading - excludes the token.
+func splitQuery(s string) ([]queryToken, error) {
+	ret := make([]queryToken, 0)
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		if unicode.IsSpace(rs[i]) {
+			i++
+			continue
+		}
+		t := queryToken{}
+		if rs[i] == '-' && i+1 < len(rs) && !unicode.IsSpace(rs[i+1]) {
+			t.exclude = true
+			i++
+		}
+		t.quoted = rs[i] == '"'
+		start := i
+		var b strings.Builder
+		inQuote := false
+		for ; i < len(rs) && (inQuote || !unicode.IsSpace(rs[i])); i++ {
+			if rs[i] == '"' {
+				inQuote = !inQuote
+				continue
+			}
+			b.WriteRune(rs[i])
+		}
+		if inQuote {
+			return nil, fmt.Errorf("Missing closing quote: %s", string(rs[start:]))
+		}
+		t.text = b.String()
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
+
+// parseQuery splits the search query s into the words and quoted phrases to
+// match, and applies its fields and excluded words to f. Words ending in *
+// match as prefixes. Words without letters or digits are dropped since they
+// can't match anything. Only known fields with a value are fields, so words
+// like "Mission:" in titles are matched as text.
+func parseQuery(s string, f *SearchFilter) ([]string, error) {
+	tokens, err := splitQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	words := make([]string, 0)
+	for _, t := range tokens {
+		i := strings.Index(t.text, ":")
+		if t.quoted || i <= 0 || i == len(t.text)-1 || !queryFields[strings.ToLower(t.text[:i])] {
+			if len(searchTokens(t.text)) == 0 {
+				continue
+			}
+			if t.exclude {
+				f.Exclude = append(f.Exclude, t.text)
+			} else {
+				words = append(words, t.text)
+			}
+			continue
+		}
+		k, v := strings.ToLower(t.text[:i]), t.text[i+1:]
+		if t.exclude {
+			return nil, fmt.Errorf("Only words and phrases can be excluded: -%s", t.text)
+		}
+		if err := applyQueryField(k, v, f); err != nil {
+			return nil, fmt.Errorf("Invalid %s:%s, %s", k, v, err)
+		}
+	}
+	return words, nil
+}
+
+// applyQueryField narrows f with the field k set to v.
+func applyQueryField(k string, v string, f *SearchFilter) error {
+	var err error
+	switch k {
+	case "year":
+		f.Year, err = strconv.Atoi(v)
+	case "s":
+		f.Season, err = strconv.Atoi(v)
+	case "e":
+		f.Episode, err = strconv.Atoi(v)
+	case "res":
+		f.Resolution = strings.ToLower(v)
+	case "codec":
+		f.Codec = strings.ToLower(v)
+	case "src":
+		f.ReleaseSource = strings.ToLower(v)
+	case "group":
+		f.Group = v
+	case "size":
+		op, n := parseComparison(v)
+		size, err := parseSize(n)
+		if err != nil {
+			return err
+		}
+		f.Size.narrow(op, size)
+	case "announces":
+		op, n := parseComparison(v)
+		count, err := strconv.ParseInt(n, 10, 64)
+		if err != nil || count < 0 {
+			return fmt.Errorf("expected a count like announces:>10")
+		}
+		f.Announces.narrow(op, count)
+	case "after", "before":
+		d, err := time.ParseInLocation(queryDateLayout, v, time.Local)
+		if err != nil {
+			return fmt.Errorf("expected a date like %s:2019-06-01", k)
+		}
+		if k == "after" && d.After(f.After) {
+			f.After = d
+		}
+		if k == "before" && (f.Before.IsZero() || d.Before(f.Before)) {
+			f.Before = d
+		}
+	case "ext":
+		for _, e := range strings.Split(v, ",") {
+			e = strings.ToLower(strings.TrimPrefix(e, "."))
+			if e == "" || strings.IndexFunc(e, func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+			}) >= 0 {
+				return fmt.Errorf("expected extensions like ext:iso or ext:mkv,mp4")
+			}
+			f.Extensions = append(f.Extensions, e)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("expected a number")
+	}
+	return nil
+}
+
+// parseComparison splits v into a comparison operator, one of >, >=, <, <=
+// or =, and its operand. No operator means =.
+func parseComparison(v string) (string, string) {
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(v, op) {
+			return op, v[len(op):]
+		}
+	}
+	return "", v
+}
+
+// parseSize parses a size in bytes like 700MB or 1.5GiB. KB, MB, GB and TB
+// are decimal units and KiB, MiB, GiB and TiB binary ones.
+func parseSize(s string) (int64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsLetter(r)
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	unit, ok := sizeUnits[strings.ToLower(s[i:])]
+	if err != nil || !ok || n < 0 {
+		return 0, fmt.Errorf("expected a size like 700MB or 1.5GiB")
+	}
+	return int64(n * unit), nil
+}
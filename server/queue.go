@@ -0,0 +1,102 @@
+package server
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// queuePollInterval is how long the dispatcher waits when the resolve
+	// queue is empty.
+	queuePollInterval = time.Second
+
+	// queueTrimInterval is how often the resolve queue is trimmed to
+	// HashQueueLength.
+	queueTrimInterval = time.Minute
+)
+
+// QueueStats describe the resolve queue. Deferred counts hashes that weren't
+// queued because they were queued within the ResolverWindow. Dropped counts
+// hashes removed from the queue because it grew past HashQueueLength.
+type QueueStats struct {
+	Depth    int64
+	Deferred int64
+	Dropped  int64
+}
+
+// queueable reports whether hx should be added to the resolve queue. Hashes
+// queued within the ResolverWindow are counted as deferred instead.
+func (s *Server) queueable(hx string) bool {
+	if !s.shouldQueue(hx) {
+		atomic.AddInt64(&s.deferred, 1)
+		return false
+	}
+	return true
+}
+
+// dispatch feeds queued hashes to the resolvers in priority order until
+// stop is closed. Hashes still waiting for a resolver when det exits are
+// returned to the queue on the next start.
+func (s *Server) dispatch(stop <-chan struct{}) {
+	if err := s.db.ResetResolveQueue(); err != nil {
+		log.Printf("ResetResolveQueue Error:\t%s", err)
+	}
+	trim := time.NewTicker(queueTrimInterval)
+	defer trim.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-trim.C:
+			n, err := s.db.TrimResolveQueue(s.config.HashQueueLength)
+			if err != nil {
+				log.Printf("TrimResolveQueue Error:\t%s", err)
+			}
+			atomic.AddInt64(&s.dropped, n)
+			continue
+		default:
+		}
+		hs, err := s.db.DequeueHashes(s.config.NumResolvers)
+		if err != nil {
+			log.Printf("DequeueHashes Error:\t%s", err)
+		}
+		if len(hs) == 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(queuePollInterval):
+			}
+			continue
+		}
+		for _, h := range hs {
+			select {
+			case s.hashes <- h:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// QueueStats returns the current state of the resolve queue.
+func (s *Server) QueueStats() (QueueStats, error) {
+	d, err := s.db.ResolveQueueDepth()
+	if err != nil {
+		return QueueStats{}, err
+	}
+	return QueueStats{
+		Depth:    d,
+		Deferred: atomic.LoadInt64(&s.deferred),
+		Dropped:  atomic.LoadInt64(&s.dropped),
+	}, nil
+}
+
+func (s *Server) logQueueStats() {
+	qs, err := s.QueueStats()
+	if err != nil {
+		log.Printf("QueueStats Error:\t%s", err)
+		return
+	}
+	log.Printf("Resolve Queue:\tdepth %d\tdeferred %d\tdropped %d", qs.Depth, qs.Deferred, qs.Dropped)
+}
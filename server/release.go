@@ -0,0 +1,146 @@
+package server
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Release is the structure parsed from a scene style release name, such as
+// "Show.Name.S02E05.1080p.WEB-DL.x264-GROUP". Fields that aren't found in
+// the name are left empty.
+type Release struct {
+	Title      string
+	Year       int
+	Season     int
+	Episode    int
+	Resolution string
+	Codec      string
+	Source     string
+	Group      string
+}
+
+var (
+	releaseYear       = regexp.MustCompile(`\b(19[2-9]\d|20\d\d)\b`)
+	releaseEpisode    = regexp.MustCompile(`(?i)\bs(\d{1,2}) ?e(\d{1,3})\b|\b(\d{1,2})x(\d{2,3})\b|\s-\s(\d{1,3})\b`)
+	releaseSeason     = regexp.MustCompile(`(?i)\bs(\d{1,2})\b|\bseason (\d{1,2})\b`)
+	releaseResolution = regexp.MustCompile(`(?i)\b(480p|576p|720p|1080[pi]|2160p|4k)\b`)
+	releaseCodec      = regexp.MustCompile(`(?i)\b([xh] ?26[45]|hevc|avc|xvid|divx|av1|vp9)\b`)
+	releaseSource     = regexp.MustCompile(`(?i)\b(blu[- ]?ray|bdrip|brrip|bdremux|remux|web[- ]?dl|webrip|web|hdtv|dvdrip|dvd|hdrip|hdcam|cam)\b`)
+	releaseGroup      = regexp.MustCompile(`-([A-Za-z0-9]+)$`)
+	releaseTagGroup   = regexp.MustCompile(`^\[([^\]]+)\]`)
+	releaseExtension  = regexp.MustCompile(`\.[A-Za-z0-9]{2,4}$`)
+)
+
+// ParseRelease extracts the release fields from a torrent name. The title is
+// everything before the first recognised field.
+func ParseRelease(name string) Release {
+	var r Release
+	n := strings.TrimSpace(name)
+	if c, ok := fileCategory(n); ok && c != CategoryOther {
+		n = releaseExtension.ReplaceAllString(n, "")
+	}
+	if m := releaseTagGroup.FindStringSubmatch(n); m != nil {
+		r.Group = m[1]
+		n = strings.TrimSpace(n[len(m[0]):])
+	}
+	if r.Group == "" {
+		if m := releaseGroup.FindStringSubmatchIndex(n); m != nil {
+			r.Group = n[m[2]:m[3]]
+			n = n[:m[0]]
+		}
+	}
+	n = strings.NewReplacer(".", " ", "_", " ", "[", " ", "]", " ", "(", " ", ")", " ").Replace(n)
+
+	end := len(n)
+	mark := func(loc []int) {
+		if loc != nil && loc[0] < end {
+			end = loc[0]
+		}
+	}
+	if m := releaseEpisode.FindStringSubmatchIndex(n); m != nil {
+		switch {
+		case m[2] >= 0:
+			r.Season, _ = strconv.Atoi(n[m[2]:m[3]])
+			r.Episode, _ = strconv.Atoi(n[m[4]:m[5]])
+		case m[6] >= 0:
+			r.Season, _ = strconv.Atoi(n[m[6]:m[7]])
+			r.Episode, _ = strconv.Atoi(n[m[8]:m[9]])
+		default:
+			// Absolute episode numbers, as in "Title - 01".
+			r.Episode, _ = strconv.Atoi(n[m[10]:m[11]])
+		}
+		mark(m)
+	} else if m := releaseSeason.FindStringSubmatchIndex(n); m != nil {
+		if m[2] >= 0 {
+			r.Season, _ = strconv.Atoi(n[m[2]:m[3]])
+		} else {
+			r.Season, _ = strconv.Atoi(n[m[4]:m[5]])
+		}
+		mark(m)
+	}
+	if m := releaseResolution.FindStringIndex(n); m != nil {
+		r.Resolution = strings.ToLower(n[m[0]:m[1]])
+		mark(m)
+	}
+	if m := releaseCodec.FindStringIndex(n); m != nil {
+		r.Codec = strings.ToLower(strings.Replace(n[m[0]:m[1]], " ", "", -1))
+		mark(m)
+	}
+	if m := releaseSource.FindStringIndex(n); m != nil {
+		s := strings.ToLower(n[m[0]:m[1]])
+		r.Source = strings.NewReplacer(" ", "-", "bluray", "blu-ray", "webdl", "web-dl").Replace(s)
+		mark(m)
+	}
+	// The last year before the other fields is the release year, so titles
+	// like "Blade Runner 2049 2017" keep their number. A year at the very
+	// start is part of the title.
+	year := -1
+	for _, m := range releaseYear.FindAllStringIndex(n, -1) {
+		if m[0] > 0 && m[0] <= end {
+			year = m[0]
+			r.Year, _ = strconv.Atoi(n[m[0]:m[1]])
+		}
+	}
+	if year >= 0 {
+		end = year
+	}
+	r.Title = strings.Trim(n[:end], " -([")
+	return r
+}
+
+// ReleaseGroup is a set of search results with the same release title, such
+// as all episodes of a series.
+type ReleaseGroup struct {
+	Title   string
+	Results []SearchResult
+}
+
+// GroupReleases groups rs by release title, keeping the order in which each
+// title first appears. Results within a group are ordered by season and
+// episode.
+func GroupReleases(rs []SearchResult) []ReleaseGroup {
+	ret := make([]ReleaseGroup, 0)
+	index := make(map[string]int)
+	for _, r := range rs {
+		k := strings.ToLower(r.Release.Title)
+		i, ok := index[k]
+		if !ok {
+			i = len(ret)
+			index[k] = i
+			ret = append(ret, ReleaseGroup{Title: r.Release.Title})
+		}
+		ret[i].Results = append(ret[i].Results, r)
+	}
+	for _, g := range ret {
+		sort.SliceStable(g.Results, func(i, j int) bool {
+			a, b := g.Results[i].Release, g.Results[j].Release
+			if a.Season != b.Season {
+				return a.Season < b.Season
+			}
+			return a.Episode < b.Episode
+		})
+	}
+	return ret
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// rollupInterval is how often announces past AnnounceRetentionDays are
+// rolled up while listening.
+const rollupInterval = time.Hour
+
+// AnnounceRollupCutoff returns the start of the UTC day days ago. Announces
+// before it are rolled up, so only whole days are.
+func AnnounceRollupCutoff(now time.Time, days int) time.Time {
+	return now.UTC().Truncate(time.Hour*24).AddDate(0, 0, -days)
+}
+
+// retainAnnounces rolls up announces older than AnnounceRetentionDays into
+// daily counts every rollupInterval until stop is closed.
+func (s *Server) retainAnnounces(stop <-chan struct{}) {
+	t := time.NewTicker(rollupInterval)
+	defer t.Stop()
+	for {
+		before := AnnounceRollupCutoff(time.Now(), s.config.AnnounceRetentionDays)
+		n, err := s.db.RollupAnnounces(before)
+		if err != nil {
+			log.Printf("RollupAnnounces Error:\t%s", err)
+		} else if n > 0 {
+			log.Printf("Rolled up %d announces before %s", n, before.Format("2006-01-02"))
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
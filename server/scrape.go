@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// scrapeTimeout is how long to wait for a tracker to answer a scrape.
+var scrapeTimeout = time.Second * 15
+
+const (
+	// udpTrackerRetries is how many times a UDP tracker request is sent
+	// before giving up (BEP 15).
+	udpTrackerRetries = 2
+
+	// udpTrackerProtocolID is the magic connection ID of a BEP 15 connect
+	// request.
+	udpTrackerProtocolID = 0x41727101980
+
+	udpActionConnect = 0
+	udpActionScrape  = 2
+	udpActionError   = 3
+
+	// scrapeCandidates is how many torrents due for a scrape are
+	// considered at each tick.
+	scrapeCandidates = 100
+)
+
+// TrackerScrape is a tracker's count of seeders, leechers and completed
+// downloads for a torrent.
+type TrackerScrape struct {
+	Tracker   string
+	ScrapedAt time.Time
+	Seeders   int
+	Leechers  int
+	Completed int
+}
+
+// ScrapeTracker scrapes the tracker at announce for the hex infohash hx.
+// announce may be a UDP (BEP 15) or HTTP(S) tracker announce URL.
+func ScrapeTracker(announce string, hx string) (TrackerScrape, error) {
+	h, err := hex.DecodeString(hx)
+	if err != nil || len(h) != 20 {
+		return TrackerScrape{}, fmt.Errorf("Invalid infohash: %s", hx)
+	}
+	u, err := url.Parse(announce)
+	if err != nil {
+		return TrackerScrape{}, err
+	}
+	ts := TrackerScrape{Tracker: announce, ScrapedAt: time.Now()}
+	switch u.Scheme {
+	case "udp":
+		err = scrapeUDP(u.Host, h, &ts)
+	case "http", "https":
+		err = scrapeHTTP(u, h, &ts)
+	default:
+		err = fmt.Errorf("Unsupported tracker scheme: %s", u.Scheme)
+	}
+	return ts, err
+}
+
+// udpTrackerRequest sends req, prefixed with the action and a new
+// transaction ID, and returns the body of the matching response.
+func udpTrackerRequest(conn net.Conn, prefix []byte, action int32, body []byte) ([]byte, error) {
+	tx := rand.Int31()
+	req := new(bytes.Buffer)
+	req.Write(prefix)
+	binary.Write(req, binary.BigEndian, action)
+	binary.Write(req, binary.BigEndian, tx)
+	req.Write(body)
+	b := make([]byte, 0x10000)
+	for i := 0; i < udpTrackerRetries; i++ {
+		if _, err := conn.Write(req.Bytes()); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(scrapeTimeout / udpTrackerRetries))
+		for {
+			n, err := conn.Read(b)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if n < 8 || int32(binary.BigEndian.Uint32(b[4:8])) != tx {
+				continue
+			}
+			switch int32(binary.BigEndian.Uint32(b[:4])) {
+			case action:
+				return b[8:n], nil
+			case udpActionError:
+				return nil, fmt.Errorf("Tracker error: %s", b[8:n])
+			default:
+				return nil, errors.New("Unexpected tracker response")
+			}
+		}
+	}
+	return nil, errors.New("Tracker timeout")
+}
+
+func scrapeUDP(host string, h []byte, ts *TrackerScrape) error {
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	prefix := make([]byte, 8)
+	binary.BigEndian.PutUint64(prefix, udpTrackerProtocolID)
+	r, err := udpTrackerRequest(conn, prefix, udpActionConnect, nil)
+	if err != nil {
+		return err
+	}
+	if len(r) < 8 {
+		return errors.New("Short tracker connect response")
+	}
+	r, err = udpTrackerRequest(conn, r[:8], udpActionScrape, h)
+	if err != nil {
+		return err
+	}
+	if len(r) < 12 {
+		return errors.New("Short tracker scrape response")
+	}
+	ts.Seeders = int(binary.BigEndian.Uint32(r[0:4]))
+	ts.Completed = int(binary.BigEndian.Uint32(r[4:8]))
+	ts.Leechers = int(binary.BigEndian.Uint32(r[8:12]))
+	return nil
+}
+
+// httpScrapeResponse is the bencoded body of an HTTP tracker scrape.
+type httpScrapeResponse struct {
+	Files map[string]struct {
+		Complete   int `bencode:"complete"`
+		Downloaded int `bencode:"downloaded"`
+		Incomplete int `bencode:"incomplete"`
+	} `bencode:"files"`
+	FailureReason string `bencode:"failure reason,omitempty"`
+}
+
+// scrapeURL returns the scrape URL of an HTTP tracker, following the
+// convention of replacing "announce" in the last path component.
+func scrapeURL(announce *url.URL) (*url.URL, error) {
+	i := strings.LastIndex(announce.Path, "/")
+	if i < 0 || !strings.HasPrefix(announce.Path[i+1:], "announce") {
+		return nil, fmt.Errorf("Tracker doesn't support scrape: %s", announce)
+	}
+	u := *announce
+	u.Path = announce.Path[:i+1] + "scrape" + strings.TrimPrefix(announce.Path[i+1:], "announce")
+	return &u, nil
+}
+
+func scrapeHTTP(announce *url.URL, h []byte, ts *TrackerScrape) error {
+	u, err := scrapeURL(announce)
+	if err != nil {
+		return err
+	}
+	q := u.RawQuery
+	if q != "" {
+		q += "&"
+	}
+	u.RawQuery = q + "info_hash=" + url.QueryEscape(string(h))
+	c := http.Client{Timeout: scrapeTimeout}
+	resp, err := c.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Tracker scrape: %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var r httpScrapeResponse
+	if err = bencode.Unmarshal(b, &r); err != nil {
+		return err
+	}
+	if r.FailureReason != "" {
+		return fmt.Errorf("Tracker error: %s", r.FailureReason)
+	}
+	f, ok := r.Files[string(h)]
+	if !ok {
+		return errors.New("Torrent not in tracker scrape")
+	}
+	ts.Seeders = f.Complete
+	ts.Leechers = f.Incomplete
+	ts.Completed = f.Downloaded
+	return nil
+}
+
+// trackerScraper periodically scrapes the trackers of resolved torrents, the
+// most popular first, at TrackerScrapeRate torrents per minute and at most
+// once per TrackerScrapeInterval for each torrent.
+type trackerScraper struct {
+	s        *Server
+	mu       sync.Mutex
+	inflight map[string]bool
+	scrapes  int
+	failures int
+	stop     chan struct{}
+}
+
+func newTrackerScraper(s *Server) *trackerScraper {
+	return &trackerScraper{
+		s:        s,
+		inflight: make(map[string]bool),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Run scrapes until Close is called.
+func (sc *trackerScraper) Run() {
+	rate := sc.s.config.TrackerScrapeRate
+	if rate <= 0 {
+		rate = 1
+	}
+	tick := time.NewTicker(time.Minute / time.Duration(rate))
+	defer tick.Stop()
+	for {
+		select {
+		case <-sc.stop:
+			return
+		case <-tick.C:
+			if hx, ok := sc.next(); ok {
+				go sc.scrape(hx)
+			}
+		}
+	}
+}
+
+// Close stops scraping.
+func (sc *trackerScraper) Close() {
+	close(sc.stop)
+}
+
+// scrapeTrackers returns the trackers to scrape for a torrent with the
+// given trackers of its own.
+func (s *Server) scrapeTrackers(own []string) []string {
+	if !s.config.ScrapeAnnounceList {
+		return own
+	}
+	ret := append([]string{}, own...)
+	for _, tier := range s.config.AnnounceList {
+		ret = append(ret, tier...)
+	}
+	return ret
+}
+
+func (sc *trackerScraper) next() (string, bool) {
+	before := time.Now().Add(-sc.s.config.TrackerScrapeInterval)
+	hs, err := sc.s.db.TrackerScrapeCandidates(before, !sc.s.config.ScrapeAnnounceList, scrapeCandidates)
+	if err != nil {
+		log.Printf("TrackerScrapeCandidates Error:\t%s", err)
+		return "", false
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, hx := range hs {
+		if !sc.inflight[hx] {
+			sc.inflight[hx] = true
+			return hx, true
+		}
+	}
+	return "", false
+}
+
+func (sc *trackerScraper) scrape(hx string) {
+	defer func() {
+		sc.mu.Lock()
+		delete(sc.inflight, hx)
+		sc.mu.Unlock()
+	}()
+	own, err := sc.s.db.GetTrackers(hx)
+	if err != nil {
+		log.Printf("GetTrackers Error:\t%s", err)
+		return
+	}
+	scrapes := make([]TrackerScrape, 0)
+	for _, tr := range sc.s.scrapeTrackers(own) {
+		ts, err := ScrapeTracker(tr, hx)
+		sc.mu.Lock()
+		if err != nil {
+			sc.failures++
+		} else {
+			sc.scrapes++
+			scrapes = append(scrapes, ts)
+		}
+		sc.mu.Unlock()
+	}
+	if err = sc.s.db.RecordTrackerScrapes(hx, time.Now(), scrapes); err != nil {
+		log.Printf("RecordTrackerScrapes Error:\t%s", err)
+	}
+}
+
+func (sc *trackerScraper) logStats() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	log.Printf("Tracker Scrapes:\tscraped %d\tfailed %d\tin flight %d", sc.scrapes, sc.failures, len(sc.inflight))
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+const testScrapeHash = "0123456789abcdef0123456789abcdef01234567"
+
+// withScrapeTimeout lowers scrapeTimeout for the duration of a test.
+func withScrapeTimeout(t *testing.T, d time.Duration) {
+	old := scrapeTimeout
+	scrapeTimeout = d
+	t.Cleanup(func() { scrapeTimeout = old })
+}
+
+func checkScrape(t *testing.T, ts TrackerScrape, err error, wantErr string, seeders, leechers, completed int) {
+	t.Helper()
+	if wantErr != "" {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("got error %v, want %q", err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Seeders != seeders || ts.Leechers != leechers || ts.Completed != completed {
+		t.Errorf("got %d seeders, %d leechers, %d completed, want %d, %d, %d",
+			ts.Seeders, ts.Leechers, ts.Completed, seeders, leechers, completed)
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	withScrapeTimeout(t, 200*time.Millisecond)
+	h, _ := hex.DecodeString(testScrapeHash)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr string
+	}{
+		{"ok", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/scrape" || r.URL.Query().Get("info_hash") != string(h) || r.URL.Query().Get("key") != "k" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(bencode.MustMarshal(map[string]interface{}{
+				"files": map[string]interface{}{
+					string(h): map[string]int{"complete": 3, "incomplete": 5, "downloaded": 7},
+				},
+			}))
+		}, ""},
+		{"failure", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(bencode.MustMarshal(map[string]string{"failure reason": "unregistered torrent"}))
+		}, "Tracker error: unregistered torrent"},
+		{"missing", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(bencode.MustMarshal(map[string]interface{}{"files": map[string]interface{}{}}))
+		}, "Torrent not in tracker scrape"},
+		{"status", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}, "503"},
+		{"timeout", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(500 * time.Millisecond)
+		}, "Timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+			ts, err := ScrapeTracker(srv.URL+"/announce?key=k", testScrapeHash)
+			checkScrape(t, ts, err, tt.wantErr, 3, 5, 7)
+		})
+	}
+}
+
+func TestScrapeURL(t *testing.T) {
+	_, err := ScrapeTracker("http://127.0.0.1/tracker", testScrapeHash)
+	checkScrape(t, TrackerScrape{}, err, "doesn't support scrape", 0, 0, 0)
+}
+
+// udpTestTracker is a local BEP 15 tracker. reply answers a scrape and
+// returns the action and body to send, or false to drop it.
+type udpTestTracker struct {
+	conn  net.PacketConn
+	reply func() (int32, []byte, bool)
+}
+
+func newUDPTestTracker(t *testing.T, reply func() (int32, []byte, bool)) *udpTestTracker {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &udpTestTracker{conn, reply}
+	go tr.serve(t)
+	t.Cleanup(func() { conn.Close() })
+	return tr
+}
+
+func (tr *udpTestTracker) URL() string {
+	return "udp://" + tr.conn.LocalAddr().String() + "/announce"
+}
+
+func (tr *udpTestTracker) serve(t *testing.T) {
+	connID := []byte("conn-id!")
+	b := make([]byte, 1500)
+	for {
+		n, addr, err := tr.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+		action := int32(binary.BigEndian.Uint32(b[8:12]))
+		tx := b[12:16]
+		var replyAction int32
+		var body []byte
+		switch {
+		case action == udpActionConnect && binary.BigEndian.Uint64(b[:8]) == udpTrackerProtocolID:
+			replyAction, body = udpActionConnect, connID
+		case action == udpActionScrape && bytes.Equal(b[:8], connID):
+			if h, _ := hex.DecodeString(testScrapeHash); !bytes.Equal(b[16:n], h) {
+				t.Errorf("scraped %x", b[16:n])
+				continue
+			}
+			var ok bool
+			if replyAction, body, ok = tr.reply(); !ok {
+				continue
+			}
+		default:
+			t.Errorf("unexpected request %x", b[:n])
+			continue
+		}
+		resp := new(bytes.Buffer)
+		binary.Write(resp, binary.BigEndian, replyAction)
+		resp.Write(tx)
+		resp.Write(body)
+		tr.conn.WriteTo(resp.Bytes(), addr)
+	}
+}
+
+func TestScrapeUDP(t *testing.T) {
+	withScrapeTimeout(t, 200*time.Millisecond)
+	tests := []struct {
+		name    string
+		reply   func() (int32, []byte, bool)
+		wantErr string
+	}{
+		{"ok", func() (int32, []byte, bool) {
+			body := make([]byte, 12)
+			binary.BigEndian.PutUint32(body[0:4], 3)
+			binary.BigEndian.PutUint32(body[4:8], 7)
+			binary.BigEndian.PutUint32(body[8:12], 5)
+			return udpActionScrape, body, true
+		}, ""},
+		{"error", func() (int32, []byte, bool) {
+			return udpActionError, []byte("unregistered torrent"), true
+		}, "Tracker error: unregistered torrent"},
+		{"short", func() (int32, []byte, bool) {
+			return udpActionScrape, []byte{0, 0, 0, 1}, true
+		}, "Short tracker scrape response"},
+		{"timeout", func() (int32, []byte, bool) {
+			return 0, nil, false
+		}, "Tracker timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newUDPTestTracker(t, tt.reply)
+			ts, err := ScrapeTracker(tr.URL(), testScrapeHash)
+			checkScrape(t, ts, err, tt.wantErr, 3, 5, 7)
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Snippets mark the words that matched a search with HighlightStart and
+// HighlightEnd.
+const (
+	HighlightStart = "\x02"
+	HighlightEnd   = "\x03"
+)
+
+// snippetWords is the most words shown in a snippet.
+const snippetWords = 16
+
+// blendCandidates is how many results for each one wanted are ranked by
+// relevance before OrderBlended mixes in popularity.
+const blendCandidates = 10
+
+// SearchResult is a torrent matching a search. Relevance scores how well the
+// text matched, higher is better, and is 0 for searches with only facets.
+// Snippet is the best matching name or file path, trimmed to the matched
+// words and highlighted, and File is the file it names. File is nil when
+// the name of a multi-file torrent matched and for searches without words.
+type SearchResult struct {
+	Torrent
+	Relevance float64
+	Snippet   string
+	File      *FileInfo
+}
+
+// SearchOrder selects how search results are ranked.
+type SearchOrder int
+
+const (
+	// OrderRelevance ranks results by how well the text matched (bm25).
+	OrderRelevance SearchOrder = iota
+	// OrderPopular ranks results by announce count.
+	OrderPopular
+	// OrderBlended ranks results by relevance weighted by popularity.
+	OrderBlended
+)
+
+var searchOrderNames = map[SearchOrder]string{
+	OrderRelevance: "relevance",
+	OrderPopular:   "popular",
+	OrderBlended:   "blended",
+}
+
+// ParseSearchOrder returns the SearchOrder named s.
+func ParseSearchOrder(s string) (SearchOrder, error) {
+	for o, n := range searchOrderNames {
+		if n == s {
+			return o, nil
+		}
+	}
+	return OrderRelevance, fmt.Errorf("Unknown search order: %s", s)
+}
+
+func (o SearchOrder) String() string {
+	return searchOrderNames[o]
+}
+
+// blendScore weights relevance by popularity. Announces count with
+// diminishing returns so a popular torrent can't bury a much better match.
+func blendScore(r SearchResult, c AnnounceCounter) float64 {
+	return r.Relevance * math.Log2(2+float64(r.Rank(RankSupply, c)))
+}
+
+// sortResults orders rs by order, then by hash, and returns the top limit.
+func sortResults(rs []SearchResult, limit int, order SearchOrder, c AnnounceCounter) []SearchResult {
+	key := func(r SearchResult) float64 {
+		switch order {
+		case OrderPopular:
+			return float64(r.Rank(RankSupply, c))
+		case OrderBlended:
+			return blendScore(r, c)
+		default:
+			return r.Relevance
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		ki, kj := key(rs[i]), key(rs[j])
+		if ki != kj {
+			return ki > kj
+		}
+		return rs[i].InfoHash < rs[j].InfoHash
+	})
+	if len(rs) > limit {
+		rs = rs[:limit]
+	}
+	return rs
+}
+
+// ftsQuery matches every word and phrase of words. Each is quoted so
+// punctuation common in release names, like "web-dl" or "x.264", is matched
+// literally instead of being read as full text query syntax. A trailing * is
+// kept as a prefix match.
+func ftsQuery(words []string) string {
+	terms := make([]string, 0)
+	for _, w := range words {
+		prefix := ""
+		if strings.HasSuffix(w, "*") {
+			w, prefix = strings.TrimRight(w, "*"), "*"
+		}
+		if w != "" {
+			terms = append(terms, `"`+strings.Replace(strings.ToLower(w), `"`, `""`, -1)+`"`+prefix)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// queryWord is a search token. Prefix words match tokens they start.
+type queryWord struct {
+	token  string
+	prefix bool
+}
+
+func (w queryWord) matches(token string) bool {
+	return token == w.token || (w.prefix && strings.HasPrefix(token, w.token))
+}
+
+// queryTerm is a word or phrase of a search, matched as a run of tokens.
+// Only its last token can be a prefix, like FTS5.
+type queryTerm []queryWord
+
+// parseQueryTerms splits the words and phrases of a search into tokens like
+// searchTokens. Terms ending in * are prefix matches.
+func parseQueryTerms(words []string) []queryTerm {
+	ret := make([]queryTerm, 0)
+	for _, w := range words {
+		tokens := searchTokens(w)
+		if len(tokens) == 0 {
+			continue
+		}
+		t := make(queryTerm, len(tokens))
+		for i, token := range tokens {
+			t[i] = queryWord{token, false}
+		}
+		t[len(t)-1].prefix = strings.HasSuffix(w, "*")
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+// in reports if the tokens of t appear in order in tokens.
+func (t queryTerm) in(tokens []string) bool {
+	for i := 0; i+len(t) <= len(tokens); i++ {
+		j := 0
+		for j < len(t) && t[j].matches(tokens[i+j]) {
+			j++
+		}
+		if j == len(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTerms reports if every term is in tokens.
+func matchTerms(tokens []string, terms []queryTerm) bool {
+	for _, t := range terms {
+		if !t.in(tokens) {
+			return false
+		}
+	}
+	return true
+}
+
+// termWords returns the words of terms, which are scored and highlighted
+// one by one.
+func termWords(terms []queryTerm) []queryWord {
+	ret := make([]queryWord, 0)
+	for _, t := range terms {
+		ret = append(ret, t...)
+	}
+	return ret
+}
+
+func countMatches(tokens []string, w queryWord) int {
+	n := 0
+	for _, t := range tokens {
+		if w.matches(t) {
+			n++
+		}
+	}
+	return n
+}
+
+// bm25 returns a function scoring a document's tokens against words, with
+// term frequencies taken from docs. It uses the same parameters as FTS5 but
+// returns positive scores.
+func bm25(docs [][]string, words []queryWord) func(tokens []string) float64 {
+	const k1, b = 1.2, 0.75
+	total := 0
+	df := make([]int, len(words))
+	for _, d := range docs {
+		total += len(d)
+		for i, w := range words {
+			if countMatches(d, w) > 0 {
+				df[i]++
+			}
+		}
+	}
+	n := float64(len(docs))
+	avg := float64(total) / math.Max(n, 1)
+	idf := make([]float64, len(words))
+	for i := range words {
+		nq := float64(df[i])
+		idf[i] = math.Max(math.Log((n-nq+0.5)/(nq+0.5)), 1e-6)
+	}
+	return func(tokens []string) float64 {
+		score := 0.0
+		for i, w := range words {
+			tf := float64(countMatches(tokens, w))
+			score += idf[i] * tf * (k1 + 1) / (tf + k1*(1-b+b*float64(len(tokens))/avg))
+		}
+		return score
+	}
+}
+
+// snippet highlights the tokens of name matching words, trimmed to
+// snippetWords tokens starting a little before the first match.
+func snippet(name string, words []queryWord) string {
+	type span struct {
+		start, end int
+		match      bool
+	}
+	spans := make([]span, 0)
+	start := -1
+	for i, r := range name + " " {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			spans = append(spans, span{start: start, end: i})
+			start = -1
+		}
+	}
+	first := -1
+	for i := range spans {
+		t := strings.ToLower(name[spans[i].start:spans[i].end])
+		for _, w := range words {
+			spans[i].match = spans[i].match || w.matches(t)
+		}
+		if spans[i].match && first < 0 {
+			first = i
+		}
+	}
+	from := first - snippetWords/4
+	if from < 0 {
+		from = 0
+	}
+	to := from + snippetWords
+	if to > len(spans) {
+		to = len(spans)
+	}
+	var b strings.Builder
+	pos, end := 0, len(name)
+	if from > 0 {
+		b.WriteString("…")
+		pos = spans[from].start
+	}
+	if to < len(spans) {
+		end = spans[to-1].end
+	}
+	// Runs of matching tokens are highlighted together, like phrases.
+	open, last := false, pos
+	for _, s := range spans[from:to] {
+		if s.match && !open {
+			b.WriteString(name[pos:s.start] + HighlightStart)
+			pos, open = s.start, true
+		} else if !s.match && open {
+			b.WriteString(name[pos:last] + HighlightEnd)
+			pos, open = last, false
+		}
+		last = s.end
+	}
+	if open {
+		b.WriteString(name[pos:last] + HighlightEnd)
+		pos = last
+	}
+	b.WriteString(name[pos:end])
+	if end < len(name) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// searchTokens splits s into lower case words of letters and digits.
+func searchTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
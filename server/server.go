@@ -1,6 +1,8 @@
 package server
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"errors"
@@ -20,40 +22,108 @@ import (
 	"github.com/muesli/cache2go"
 )
 
+// statsInterval is how often DHT and resolve queue stats are logged while
+// listening.
+const statsInterval = time.Minute * 10
+
 // Server is a det peer that contains torrent, dht and det specifc
 // functionality.
 type Server struct {
 	config       *Config
 	client       *torrent.Client
 	hashes       chan string
-	db           *SqliteDBClient
+	db           Store
 	hashLock     sync.Mutex
 	resolveCache *cache2go.CacheTable
+	hintCache    *cache2go.CacheTable
 	listen       bool
 	seed         bool
 	peers        []torrent.Peer
 	peerEvents   <-chan torrent.Peer
+	crawler      *crawler
+	swarm        *swarmSampler
+	scraper      *trackerScraper
+	identities   []*dhtIdentity
+	deferred     int64
+	dropped      int64
+	ingest       *ingestWriter
 }
 
+// Announcer IP modes control what is stored for the network address of each
+// announcing node.
+const (
+	// AnnounceIPStore stores announcer IPs as seen.
+	AnnounceIPStore = "store"
+	// AnnounceIPHash stores a keyed hash of announcer IPs. Distinct IPs can
+	// still be counted but not recovered without AnnounceIPSalt, which must
+	// be set: the IPv4 space is small enough to reverse an unkeyed hash.
+	AnnounceIPHash = "hash"
+	// AnnounceIPDrop stores no announcer IPs.
+	AnnounceIPDrop = "drop"
+)
+
 // Config tells the Server if it should listen (build a db of resolved announce
 // hashes) and seed (share files on the torrent network after they are
 // complete). Seeding will also result in participation in the det peer
-// discovery protocol.
+// discovery protocol. AnnounceIPMode is one of AnnounceIPStore, AnnounceIPHash
+// or AnnounceIPDrop. Crawl enables active BEP 51 crawling of the DHT while
+// listening. DHTIdentities is the number of extra DHT nodes to run while
+// listening, spread evenly across the keyspace. HashQueueLength is the
+// maximum number of hashes waiting in the resolve queue. Failed resolves are
+// retried with exponential backoff starting at ResolverBackoff, and hashes
+// are marked dead after ResolverMaxAttempts failures. Announces and lookups
+// are written in batches of IngestBatchSize at least every
+// IngestFlushInterval, with up to IngestQueueLength waiting. AnnounceList
+// holds the tracker tiers added to exported .torrent files. SwarmSample
+// enables sampling swarm sizes of resolved torrents with DHT get_peers while
+// listening, at SwarmSampleRate lookups per minute and at most once per
+// SwarmSampleInterval for each torrent. TrackerScrape enables scraping the
+// trackers listed in resolved metadata, plus AnnounceList if
+// ScrapeAnnounceList is set, at TrackerScrapeRate torrents per minute and at
+// most once per TrackerScrapeInterval for each torrent. Store selects the
+// index backend, StoreSQLite (the default) in SqlitePath, StorePostgres at
+// PostgresURL or StoreMemory. While listening, announces older than
+// AnnounceRetentionDays are rolled up into daily counts and deleted, unless it
+// is 0.
 type Config struct {
-	ListenHost      string
-	ListenPort      int
-	PublicHost      string
-	DisableUpnp     bool
-	HashQueueLength int
-	SqlitePath      string
-	BoltDBPath      string
-	DownloadPath    string
-	Listen          bool
-	Seed            bool
-	NumResolvers    int
-	ResolverTimeout time.Duration
-	ResolverWindow  time.Duration
-	TorrentDebug    bool
+	ListenHost            string
+	ListenPort            int
+	PublicHost            string
+	DisableUpnp           bool
+	HashQueueLength       int
+	Store                 string
+	SqlitePath            string
+	PostgresURL           string
+	BoltDBPath            string
+	DownloadPath          string
+	Listen                bool
+	Seed                  bool
+	NumResolvers          int
+	ResolverTimeout       time.Duration
+	ResolverWindow        time.Duration
+	ResolverBackoff       time.Duration
+	ResolverMaxBackoff    time.Duration
+	ResolverMaxAttempts   int
+	TorrentDebug          bool
+	AnnounceIPMode        string
+	AnnounceIPSalt        string
+	Crawl                 bool
+	CrawlRate             int
+	CrawlMaxNodes         int
+	CrawlNodeInterval     time.Duration
+	DHTIdentities         int
+	IngestBatchSize       int
+	IngestFlushInterval   time.Duration
+	IngestQueueLength     int
+	AnnounceList          [][]string
+	SwarmSample           bool
+	SwarmSampleRate       int
+	SwarmSampleInterval   time.Duration
+	TrackerScrape         bool
+	TrackerScrapeRate     int
+	TrackerScrapeInterval time.Duration
+	ScrapeAnnounceList    bool
+	AnnounceRetentionDays int
 }
 
 // NewServer returns a Server configured with cfg.
@@ -61,21 +131,35 @@ func NewServer(cfg *Config) (*Server, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("Missing server config")
 	}
-	db, err := NewSqliteDB(cfg.SqlitePath)
+	switch cfg.AnnounceIPMode {
+	case AnnounceIPStore, AnnounceIPDrop:
+	case AnnounceIPHash:
+		if cfg.AnnounceIPSalt == "" {
+			return nil, fmt.Errorf("AnnounceIPMode %q needs a secret AnnounceIPSalt", AnnounceIPHash)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid announce IP mode: %q", cfg.AnnounceIPMode)
+	}
+	db, err := NewStore(cfg)
 	if err != nil {
 		return nil, err
 	}
 	s := &Server{
 		config:       cfg,
 		client:       nil,
-		hashes:       make(chan string, cfg.HashQueueLength),
+		hashes:       make(chan string),
 		resolveCache: cache2go.Cache("resolveCache"),
+		hintCache:    cache2go.Cache("hintCache"),
 		listen:       cfg.Listen,
 		seed:         cfg.Seed,
 		db:           db,
 		peers:        make([]torrent.Peer, 0),
 		peerEvents:   nil,
+		identities:   []*dhtIdentity{{index: 0}},
 	}
+	s.ingest = newIngestWriter(db, cfg, func(hx string) {
+		s.resolveCache.Delete(hx)
+	})
 
 	torrentCfg := torrent.NewDefaultClientConfig()
 	torrentCfg.ListenHost = func(network string) string { return cfg.ListenHost }
@@ -90,7 +174,7 @@ func NewServer(cfg *Config) (*Server, error) {
 	}
 	torrentCfg.DefaultStorage = storage.NewBoltDB(cfg.BoltDBPath)
 	if s.listen {
-		torrentCfg.DHTOnQuery = s.onQuery
+		torrentCfg.DHTOnQuery = s.identities[0].onQuery(s)
 	}
 	cl, err := torrent.NewClient(torrentCfg)
 	id := cl.PeerID()
@@ -98,6 +182,16 @@ func NewServer(cfg *Config) (*Server, error) {
 		return nil, err
 	}
 	s.client = cl
+	if ds := cl.DhtServers(); len(ds) > 0 {
+		s.identities[0].server = ds[0]
+	}
+	if s.listen && cfg.DHTIdentities > 0 {
+		if err := s.startIdentities(); err != nil {
+			s.closeIdentities()
+			cl.Close()
+			return nil, err
+		}
+	}
 	log.Printf("Torrent Peer ID: %s", metainfo.HashBytes(id[:]).HexString())
 	log.Printf("Listen Address: %s", cfg.ListenHost)
 	log.Printf("Listen Port: %d", cfg.ListenPort)
@@ -112,8 +206,8 @@ func NewServer(cfg *Config) (*Server, error) {
 	return s, nil
 }
 
-// DB returns the servers underlying database.
-func (s *Server) DB() *SqliteDBClient {
+// DB returns the servers underlying store.
+func (s *Server) DB() Store {
 	return s.db
 }
 
@@ -130,10 +224,67 @@ func (s *Server) Run() {
 				if err != nil {
 					log.Println(err)
 				}
+				if err = s.db.FinishHash(h); err != nil {
+					log.Printf("FinishHash Error:\t%s", err)
+				}
 			}
 		}()
 	}
-	<-sigs
+	go s.ingest.Run()
+	stop := make(chan struct{})
+	go s.dispatch(stop)
+	if s.listen && s.config.Crawl {
+		cr, err := newCrawler(s)
+		if err != nil {
+			log.Printf("Crawler error: %s", err)
+		} else {
+			log.Printf("Crawling at %d queries per second", s.config.CrawlRate)
+			s.crawler = cr
+			go cr.Run()
+		}
+	}
+	if s.listen && s.config.SwarmSample {
+		ss, err := newSwarmSampler(s)
+		if err != nil {
+			log.Printf("Swarm sampler error: %s", err)
+		} else {
+			log.Printf("Sampling swarms at %d lookups per minute", s.config.SwarmSampleRate)
+			s.swarm = ss
+			go ss.Run()
+		}
+	}
+	if s.listen && s.config.TrackerScrape {
+		log.Printf("Scraping trackers at %d torrents per minute", s.config.TrackerScrapeRate)
+		s.scraper = newTrackerScraper(s)
+		go s.scraper.Run()
+	}
+	if s.listen && s.config.AnnounceRetentionDays > 0 {
+		log.Printf("Rolling up announces after %d days", s.config.AnnounceRetentionDays)
+		go s.retainAnnounces(stop)
+	}
+	stats := time.NewTicker(statsInterval)
+	defer stats.Stop()
+	for done := false; !done; {
+		select {
+		case <-stats.C:
+			s.logStats()
+		case <-sigs:
+			done = true
+		}
+	}
+	close(stop)
+	s.logStats()
+	if s.crawler != nil {
+		s.crawler.Close()
+	}
+	if s.swarm != nil {
+		s.swarm.Close()
+	}
+	if s.scraper != nil {
+		s.scraper.Close()
+	}
+	s.closeIdentities()
+	s.ingest.Close()
 	_ = s.db.Close()
 	// log.Printf("Exiting Detergent, here are some stats:")
 	// s.client.WriteStatus(os.Stderr)
@@ -244,65 +395,149 @@ func (s *Server) TorrentClient() *torrent.Client {
 }
 
 func (s *Server) onQuery(query *krpc.Msg, source net.Addr) bool {
-	if query.Q == "announce_peer" {
+	switch query.Q {
+	case "announce_peer":
 		s.hashLock.Lock()
 		defer s.hashLock.Unlock()
 		hx := hex.EncodeToString(query.A.InfoHash[:])
 		p := hex.EncodeToString(query.A.ID[:])
-		if err := s.addHash(hx); err != nil {
-			log.Printf("Error adding hash: %s", err)
-			return true
-		}
-		if err := s.db.CreateAnnounce(hx, p); err != nil {
-			log.Printf("CreateAnnounce Error:\t%s", err)
+		ip, port := announceEndpoint(query.A, source)
+		s.addHint(hx, ip, port)
+		r := ingestRecord{
+			announce: &Announce{
+				InfoHash:    hx,
+				PeerID:      p,
+				IP:          s.storedIP(ip),
+				Port:        port,
+				ImpliedPort: query.A.ImpliedPort,
+			},
 		}
-		// have we tried to resolve this in the last 10 mins?
-		if !s.resolveCache.Exists(hx) {
-			s.resolveCache.Add(hx, s.config.ResolverWindow, true)
-			s.hashes <- hx
+		if s.queueable(hx) {
+			r.queue = hx
 		}
+		s.ingest.Add(r)
+	case "get_peers":
+		// Lookups are recorded as demand but not resolved. Unlike an
+		// announce, a lookup doesn't mean anyone has the metadata.
+		hx := hex.EncodeToString(query.A.InfoHash[:])
+		p := hex.EncodeToString(query.A.ID[:])
+		s.ingest.Add(ingestRecord{lookup: &Lookup{InfoHash: hx, NodeID: p}})
+	}
+	return true
+}
+
+// announceEndpoint returns the announcer IP and torrent port from an
+// announce_peer query.
+func announceEndpoint(a *krpc.MsgArgs, source net.Addr) (net.IP, int) {
+	ua, ok := source.(*net.UDPAddr)
+	if !ok {
+		return nil, a.Port
+	}
+	if a.ImpliedPort {
+		return ua.IP, ua.Port
+	}
+	return ua.IP, a.Port
+}
+
+// storedIP returns ip as it should be stored for the AnnounceIPMode.
+func (s *Server) storedIP(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	switch s.config.AnnounceIPMode {
+	case AnnounceIPStore:
+		return ip.String()
+	case AnnounceIPHash:
+		m := hmac.New(sha256.New, []byte(s.config.AnnounceIPSalt))
+		m.Write([]byte(ip.String()))
+		return hex.EncodeToString(m.Sum(nil))
+	default:
+		return ""
 	}
+}
+
+// shouldQueue reports whether hx should be queued for resolving. Hashes are
+// queued at most once per ResolverWindow.
+func (s *Server) shouldQueue(hx string) bool {
+	if s.resolveCache.Exists(hx) {
+		return false
+	}
+	s.resolveCache.Add(hx, s.config.ResolverWindow, true)
 	return true
 }
 
-func (s *Server) addHash(hx string) error {
+// queueNewHash adds hx to the db and queues it for resolving unless it is
+// already resolved. It returns true if hx was queued.
+func (s *Server) queueNewHash(hx string) (bool, error) {
 	if len(hx) != 40 {
-		return errors.New("Invalid hash length")
+		return false, errors.New("Invalid hash length")
+	}
+	st, err := s.db.GetTorrent(hx)
+	if err == nil && !st.ResolvedAt.IsZero() {
+		return false, nil
+	} else if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	s.hashLock.Lock()
+	defer s.hashLock.Unlock()
+	if !s.queueable(hx) {
+		return false, nil
 	}
-	return s.db.CreateTorrent(hx)
+	return s.ingest.Add(ingestRecord{queue: hx}), nil
+}
+
+func (s *Server) logStats() {
+	if s.listen {
+		s.logIdentityStats()
+		st := s.ingest.Stats()
+		log.Printf("Ingest:\twritten %d\tbatches %d\t%.1f/s\tpending %d\tdropped %d\tfailed %d\tlag %s\tmax lag %s",
+			st.Written, st.Batches, st.Rate, st.Pending, st.Dropped, st.Failed, st.Lag, st.MaxLag)
+		if s.swarm != nil {
+			s.swarm.logStats()
+		}
+		if s.scraper != nil {
+			s.scraper.logStats()
+		}
+	}
+	s.logQueueStats()
+}
+
+// IngestStats returns throughput and lag of the announce and lookup writer.
+func (s *Server) IngestStats() IngestStats {
+	return s.ingest.Stats()
 }
 
 func (s *Server) resolveAndStoreHash(hx string) error {
 	st, err := s.db.GetTorrent(hx)
-	if err == sql.ErrNoRows || st.ResolvedAt.IsZero() {
+	if err == sql.ErrNoRows || st.ResolvedAt.IsZero() || st.FilesStale {
 		h := metainfo.NewHashFromHex(hx)
 		t, new := s.client.AddTorrentInfoHashWithStorage(h, make(TorrentBytes, 0))
-		if new {
-			select {
-			case <-t.GotInfo():
-				log.Printf("Resolved:\t%s\t%s", hx, t.Name())
-				err = s.db.CreateTorrentSearch(hx, t.Name())
-				if err != nil {
-					return err
-				}
-				info := t.Info()
-				for i, fi := range info.Files {
-					for _, p := range fi.Path {
-						err = s.db.CreateFileInfo(hx, p, fi.Length, i)
-						err = s.db.CreateTorrentSearch(hx, p)
-					}
-				}
-				err = s.db.SetTorrentMeta(hx, t.Name(), t.Length())
-				if err != nil {
-					return err
-				}
-			case <-time.After(s.config.ResolverTimeout):
-				// log.Printf("Timeout:\t%s", h)
-			}
-		} else {
+		defer t.Drop()
+		if !new {
 			log.Printf("Resolved Found:\t%s", t)
+			return nil
+		}
+		hints := s.hintPeers(hx)
+		if len(hints) > 0 {
+			t.AddPeers(hints)
+		}
+		select {
+		case <-t.GotInfo():
+			log.Printf("Resolved:\t%s\t%s", hx, t.Name())
+			if err = s.storeInfo(hx, t); err != nil {
+				s.recordResolveFailure(st, hx, fmt.Sprintf("store: %s", err))
+				return err
+			}
+			s.recordHint(hx, len(hints), true)
+		case <-time.After(s.config.ResolverTimeout):
+			log.Printf("Timeout:\t%s", hx)
+			if st.FilesStale {
+				// It stays resolved and is queued again when next seen.
+				return nil
+			}
+			s.recordResolveFailure(st, hx, "timeout")
+			s.recordHint(hx, len(hints), false)
 		}
-		t.Drop()
 	} else if err != nil {
 		return fmt.Errorf("GetTorrent err:\t%s", err)
 	} else {
@@ -311,3 +546,82 @@ func (s *Server) resolveAndStoreHash(hx string) error {
 
 	return nil
 }
+
+// storeInfo saves the resolved metadata of t.
+func (s *Server) storeInfo(hx string, t *torrent.Torrent) error {
+	info := t.Info()
+	// Names stored by an earlier resolve of stale files are replaced.
+	err := s.db.DeleteTorrentSearch(hx)
+	if err != nil {
+		return err
+	}
+	// The name of a single-file torrent is the path of its file.
+	nameFile := -1
+	if len(info.Files) == 0 {
+		nameFile = 0
+	}
+	err = s.db.CreateTorrentSearch(hx, t.Name(), nameFile)
+	if err != nil {
+		return err
+	}
+	mi := t.Metainfo()
+	err = s.db.SetTorrentInfo(hx, mi.InfoBytes)
+	if err != nil {
+		return err
+	}
+	for _, tier := range mi.UpvertedAnnounceList() {
+		if err = s.db.AddTrackers(hx, tier); err != nil {
+			return err
+		}
+	}
+	err = s.db.DeleteFileInfo(hx)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infoFiles(info) {
+		err = s.db.CreateFileInfo(hx, fi.Path, fi.Length, fi.Index)
+		if err != nil {
+			return err
+		}
+		if len(info.Files) > 0 {
+			err = s.db.CreateTorrentSearch(hx, fi.Path, fi.Index)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return s.db.SetTorrentMeta(hx, torrentMeta(info, &mi))
+}
+
+// recordHint counts a resolve attempt of hx that was given announcer
+// endpoints as initial peers.
+func (s *Server) recordHint(hx string, hints int, resolved bool) {
+	if hints == 0 {
+		return
+	}
+	if err := s.db.RecordResolveHint(hx, resolved); err != nil {
+		log.Printf("RecordResolveHint Error:\t%s", err)
+	}
+}
+
+// recordResolveFailure stores a failed resolve attempt for st. Retries back
+// off exponentially from ResolverBackoff up to ResolverMaxBackoff, and after
+// ResolverMaxAttempts failures the hash is marked dead.
+func (s *Server) recordResolveFailure(st Torrent, hx string, reason string) {
+	attempts := st.ResolveAttempts + 1
+	backoff := s.config.ResolverBackoff
+	for i := 1; i < attempts && backoff < s.config.ResolverMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.config.ResolverMaxBackoff {
+		backoff = s.config.ResolverMaxBackoff
+	}
+	dead := s.config.ResolverMaxAttempts > 0 && attempts >= s.config.ResolverMaxAttempts
+	if dead {
+		log.Printf("Dead:\t%s\tafter %d attempts", hx, attempts)
+	}
+	err := s.db.RecordResolveFailure(hx, reason, time.Now().Add(backoff), dead)
+	if err != nil {
+		log.Printf("RecordResolveFailure Error:\t%s", err)
+	}
+}
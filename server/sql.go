@@ -1,5 +1,16 @@
 package server
 
+// sqlTorrentColumns are the torrent columns read by scanTorrent, for queries
+// that alias torrent as t.
+const sqlTorrentColumns = `t.announce_count, t.infoHash, t.name, t.length, t.created_at, t.resolved_at,
+			   t.lookup_count, t.resolve_attempts, t.last_attempt_at, t.last_failure, t.dead, t.raw_announce_count,
+			   t.piece_length, t.file_count, t.private, t.source, t.creation_date, t.comment, t.created_by,
+			   t.category, t.category_confidence, t.title, t.year, t.season, t.episode,
+			   t.resolution, t.codec, t.release_source, t.release_group,
+			   t.swarm_sampled_at, t.swarm_peers, t.swarm_seeders, t.swarm_leechers,
+			   t.tracker_scraped_at, t.tracker_seeders, t.tracker_leechers, t.tracker_completed,
+			   t.files_stale`
+
 const (
 	sqlCreateTorrentTable = `CREATE TABLE IF NOT EXISTS torrent(
 				 infoHash TEXT UNIQUE,
@@ -8,6 +19,41 @@ const (
 				 resolved_at DATE DEFAULT NULL,
 				 created_at DATE DEFAULT (strftime('%s', 'now')),
 				 announce_count INTEGER DEFAULT 0,
+				 lookup_count INTEGER DEFAULT 0,
+				 resolve_attempts INTEGER DEFAULT 0,
+				 last_attempt_at DATE DEFAULT NULL,
+				 last_failure TEXT DEFAULT NULL,
+				 retry_at DATE DEFAULT NULL,
+				 dead INTEGER DEFAULT 0,
+				 hinted_attempts INTEGER DEFAULT 0,
+				 resolved_with_hint INTEGER DEFAULT 0,
+				 raw_announce_count INTEGER DEFAULT 0,
+				 piece_length INTEGER DEFAULT 0,
+				 file_count INTEGER DEFAULT 0,
+				 private INTEGER DEFAULT 0,
+				 source TEXT DEFAULT NULL,
+				 creation_date DATE DEFAULT NULL,
+				 comment TEXT DEFAULT NULL,
+				 created_by TEXT DEFAULT NULL,
+				 category TEXT DEFAULT NULL,
+				 category_confidence REAL DEFAULT 0,
+				 title TEXT DEFAULT NULL,
+				 year INTEGER DEFAULT 0,
+				 season INTEGER DEFAULT 0,
+				 episode INTEGER DEFAULT 0,
+				 resolution TEXT DEFAULT NULL,
+				 codec TEXT DEFAULT NULL,
+				 release_source TEXT DEFAULT NULL,
+				 release_group TEXT DEFAULT NULL,
+				 swarm_sampled_at DATE DEFAULT NULL,
+				 swarm_peers INTEGER DEFAULT 0,
+				 swarm_seeders INTEGER DEFAULT NULL,
+				 swarm_leechers INTEGER DEFAULT NULL,
+				 swarm_size INTEGER DEFAULT 0,
+				 tracker_scraped_at DATE DEFAULT NULL,
+				 tracker_seeders INTEGER DEFAULT 0,
+				 tracker_leechers INTEGER DEFAULT 0,
+				 tracker_completed INTEGER DEFAULT 0,
 				 unique(infoHash) ON CONFLICT IGNORE)`
 
 	sqlCreateFileInfoTable = `CREATE TABLE IF NOT EXISTS file_info(
@@ -20,53 +66,525 @@ const (
 				  infoHash TEXT,
 				  peerID TEXT,
 				  created_at DATE DEFAULT (strftime('%s', 'now')),
+				  ip TEXT DEFAULT NULL,
+				  port INTEGER DEFAULT 0,
+				  implied_port INTEGER DEFAULT 0,
 				  unique(infoHash, peerID) ON CONFLICT IGNORE)`
 
+	sqlCreateLookupTable = `CREATE TABLE IF NOT EXISTS lookup(
+				infoHash TEXT,
+				nodeID TEXT,
+				created_at DATE DEFAULT (strftime('%s', 'now')))`
+
+	sqlCreateResolveQueueTable = `CREATE TABLE IF NOT EXISTS resolve_queue(
+				      infoHash TEXT PRIMARY KEY,
+				      queued_at DATE DEFAULT (strftime('%s', 'now')),
+				      seen_at DATE DEFAULT (strftime('%s', 'now')),
+				      started_at DATE DEFAULT NULL)`
+
+	sqlCreateTorrentInfoTable = `CREATE TABLE IF NOT EXISTS torrent_info(
+				     infoHash TEXT PRIMARY KEY,
+				     info BLOB)`
+
+	sqlCreateSwarmSampleTable = `CREATE TABLE IF NOT EXISTS swarm_sample(
+				     infoHash TEXT,
+				     sampled_at DATE,
+				     peers INTEGER DEFAULT 0,
+				     seeders INTEGER DEFAULT NULL,
+				     leechers INTEGER DEFAULT NULL)`
+
+	sqlCreateSwarmSampleIndex = `CREATE INDEX IF NOT EXISTS swarm_sample_hash ON swarm_sample(infoHash, sampled_at)`
+
+	sqlCreateTorrentTrackerTable = `CREATE TABLE IF NOT EXISTS torrent_tracker(
+					infoHash TEXT,
+					url TEXT,
+					unique(infoHash, url) ON CONFLICT IGNORE)`
+
+	sqlCreateTrackerScrapeTable = `CREATE TABLE IF NOT EXISTS tracker_scrape(
+				       infoHash TEXT,
+				       tracker TEXT,
+				       scraped_at DATE,
+				       seeders INTEGER DEFAULT 0,
+				       leechers INTEGER DEFAULT 0,
+				       completed INTEGER DEFAULT 0)`
+
+	sqlCreateTrackerScrapeIndex = `CREATE INDEX IF NOT EXISTS tracker_scrape_hash ON tracker_scrape(infoHash, scraped_at)`
+
 	sqlCreateSearchTable = `CREATE VIRTUAL TABLE IF NOT EXISTS search_torrent
 				USING FTS4(infoHash PRIMARY KEY, name TEXT)`
 
+	// search_torrent moved to FTS5 in schema version 2, which also ranks
+	// matches with bm25.
+	sqlRenameFTS4SearchTable = `ALTER TABLE search_torrent RENAME TO search_torrent_fts4`
+
+	sqlCreateFTS5SearchTable = `CREATE VIRTUAL TABLE IF NOT EXISTS search_torrent
+				    USING FTS5(infoHash UNINDEXED, name)`
+
+	sqlCopyFTS4SearchTable = `INSERT INTO search_torrent (infoHash, name) SELECT infoHash, name FROM search_torrent_fts4`
+
+	sqlDropFTS4SearchTable = `DROP TABLE search_torrent_fts4`
+
+	// Since schema version 3 every searchable name and file path is stored
+	// once in search_text, with the position of the file_info row it names.
+	// search_torrent indexes it as an external content FTS5 table, kept up
+	// to date by triggers.
+	sqlCreateSearchTextTable = `CREATE TABLE IF NOT EXISTS search_text(
+				    id INTEGER PRIMARY KEY,
+				    infoHash TEXT,
+				    name TEXT,
+				    position INTEGER DEFAULT NULL,
+				    UNIQUE(infoHash, name))`
+
+	sqlCreateFileInfoIndex = `CREATE INDEX IF NOT EXISTS file_info_hash ON file_info(infoHash)`
+
+	sqlCopySearchText = `INSERT OR IGNORE INTO search_text (infoHash, name, position)
+			     SELECT s.infoHash, s.name,
+				    (SELECT min(fi.position) FROM file_info AS fi
+				     WHERE fi.infoHash = s.infoHash AND fi.path = s.name)
+			     FROM search_torrent AS s
+			     ORDER BY s.rowid`
+
+	sqlDropSearchTable = `DROP TABLE search_torrent`
+
+	sqlCreateSearchTextIndex = `CREATE VIRTUAL TABLE IF NOT EXISTS search_torrent
+				    USING FTS5(infoHash UNINDEXED, name, position UNINDEXED,
+					       content='search_text', content_rowid='id')`
+
+	sqlRebuildSearchTextIndex = `INSERT INTO search_torrent (search_torrent) VALUES ('rebuild')`
+
+	sqlCreateSearchTextInsertTrigger = `CREATE TRIGGER IF NOT EXISTS search_text_insert AFTER INSERT ON search_text BEGIN
+					    INSERT INTO search_torrent (rowid, infoHash, name, position)
+					    VALUES (new.id, new.infoHash, new.name, new.position);
+					    END`
+
+	sqlCreateSearchTextDeleteTrigger = `CREATE TRIGGER IF NOT EXISTS search_text_delete AFTER DELETE ON search_text BEGIN
+					    INSERT INTO search_torrent (search_torrent, rowid, infoHash, name, position)
+					    VALUES ('delete', old.id, old.infoHash, old.name, old.position);
+					    END`
+
 	sqlCreateTorrent = `INSERT INTO torrent (infoHash) VALUES (?)`
 
+	// Hashes only seen in lookups are marked lookup_only until they are
+	// announced or queued, so they can be left out of the torrent count.
+	sqlCreateLookupTorrent = `INSERT INTO torrent (infoHash, lookup_only) VALUES (?, 1)`
+
+	sqlClearLookupOnly = `UPDATE torrent SET lookup_only = 0 WHERE infoHash = ? AND lookup_only = 1`
+
+	sqlAddLookupOnly = `ALTER TABLE torrent ADD COLUMN lookup_only INTEGER DEFAULT 0`
+
+	// Hashes looked up before lookup_only existed are marked if nothing
+	// else is known about them.
+	sqlBackfillLookupOnly = `UPDATE torrent SET lookup_only = 1
+				 WHERE lookup_count > 0 AND raw_announce_count = 0 AND announce_count = 0
+				 AND resolved_at IS NULL AND resolve_attempts = 0
+				 AND infoHash NOT IN (SELECT infoHash FROM resolve_queue)`
+
+	// sqlCountResolveHints turns resolved_with_hint from a flag for the
+	// last hinted attempt into a count of the hinted attempts that
+	// resolved. Earlier flags count as one.
+	sqlCountResolveHints = `UPDATE torrent
+				SET resolved_with_hint = CASE WHEN resolved_with_hint > 0 THEN 1 ELSE 0 END`
+
 	sqlCreateFileInfo = `INSERT INTO file_info (infohash, path, length, position) VALUES (?, ?, ?, ?)`
 
-	sqlCreateTorrentSearch = `INSERT INTO search_torrent (infoHash, name) VALUES (?,?)`
+	sqlSetTorrentInfo = `INSERT OR REPLACE INTO torrent_info (infoHash, info) VALUES (?, ?)`
+
+	sqlGetTorrentInfo = `SELECT info FROM torrent_info WHERE infoHash = ?`
+
+	sqlDeleteFileInfo = `DELETE FROM file_info WHERE infohash = ?`
+
+	sqlCreateTorrentSearch = `INSERT OR IGNORE INTO search_text (infoHash, name, position) VALUES (?, ?, ?)`
+
+	sqlDeleteTorrentSearch = `DELETE FROM search_text WHERE infoHash = ?`
+
+	sqlAddFilesStale = `ALTER TABLE torrent ADD COLUMN files_stale INTEGER DEFAULT 0`
+
+	sqlStoredInfoHashes = `SELECT t.infoHash
+			       FROM torrent AS t
+			       INNER JOIN torrent_info AS ti ON ti.infoHash = t.infoHash
+			       WHERE t.resolved_at IS NOT NULL`
+
+	// Resolved torrents without a stored info dictionary keep the file
+	// lists stored before paths were joined, until they are resolved again.
+	sqlMarkFilesStale = `UPDATE torrent SET files_stale = 1
+			     WHERE resolved_at IS NOT NULL
+			     AND infoHash NOT IN (SELECT infoHash FROM torrent_info)`
+
+	sqlSetFilesStale = `UPDATE torrent SET files_stale = 1 WHERE infoHash = ?`
+
+	sqlEnqueueFilesStale = `INSERT OR IGNORE INTO resolve_queue (infoHash)
+				SELECT infoHash FROM torrent WHERE files_stale = 1`
+
+	// announce_daily holds announces rolled up by RollupAnnounces, counted
+	// by torrent and UTC day. day is the unix time the day starts.
+	// announces counts every announce, repeats included, and announcers the
+	// distinct nodes.
+	sqlCreateAnnounceDailyTable = `CREATE TABLE IF NOT EXISTS announce_daily(
+				       infoHash TEXT,
+				       day INTEGER,
+				       announces INTEGER DEFAULT 0,
+				       announcers INTEGER DEFAULT 0,
+				       PRIMARY KEY(infoHash, day))`
+
+	// announce_hourly counts every announce, repeats included, by torrent
+	// and UTC hour until RollupAnnounces adds them to announce_daily. hour is
+	// the unix time the hour starts.
+	sqlCreateAnnounceHourlyTable = `CREATE TABLE IF NOT EXISTS announce_hourly(
+					infoHash TEXT,
+					hour INTEGER,
+					announces INTEGER DEFAULT 0,
+					PRIMARY KEY(infoHash, hour))`
+
+	sqlCountAnnounce = `INSERT INTO announce_hourly (infoHash, hour, announces)
+			    VALUES (?, (strftime('%s', 'now') / 3600) * 3600, 1)
+			    ON CONFLICT (infoHash, hour) DO UPDATE
+			    SET announces = announce_hourly.announces + 1`
+
+	// Repeat announces were never stored before announce_hourly, so only
+	// the first announce of each node is counted.
+	sqlBackfillAnnounceHourly = `INSERT INTO announce_hourly (infoHash, hour, announces)
+				     SELECT infoHash, (created_at / 3600) * 3600, count(*)
+				     FROM announce
+				     GROUP BY infoHash, (created_at / 3600) * 3600`
+
+	sqlCreateAnnounceCreatedIndex = `CREATE INDEX IF NOT EXISTS announce_created_at ON announce(created_at)`
+
+	sqlCreateLookupCreatedIndex = `CREATE INDEX IF NOT EXISTS lookup_created_at ON lookup(created_at)`
+
+	// Only the first announce of each node is stored, so every announce
+	// rolled up is a distinct announcer.
+	sqlRollupAnnounces = `INSERT INTO announce_daily (infoHash, day, announcers)
+			      SELECT infoHash, (created_at / 86400) * 86400, count(*)
+			      FROM announce
+			      WHERE created_at < ?
+			      GROUP BY infoHash, (created_at / 86400) * 86400
+			      ON CONFLICT (infoHash, day) DO UPDATE
+			      SET announcers = announce_daily.announcers + excluded.announcers`
+
+	sqlRollupAnnounceHours = `INSERT INTO announce_daily (infoHash, day, announces)
+				  SELECT infoHash, (hour / 86400) * 86400, sum(announces)
+				  FROM announce_hourly
+				  WHERE hour < ?
+				  GROUP BY infoHash, (hour / 86400) * 86400
+				  ON CONFLICT (infoHash, day) DO UPDATE
+				  SET announces = announce_daily.announces + excluded.announces`
+
+	// announce_seen keeps the nodes whose announces RollupAnnounces deleted,
+	// so they aren't counted as new announcers when they announce again.
+	sqlCreateAnnounceSeenTable = `CREATE TABLE IF NOT EXISTS announce_seen(
+				      infoHash TEXT,
+				      peerID TEXT,
+				      PRIMARY KEY(infoHash, peerID)) WITHOUT ROWID`
+
+	sqlMarkAnnouncesSeen = `INSERT OR IGNORE INTO announce_seen (infoHash, peerID)
+				SELECT infoHash, peerID FROM announce WHERE created_at < ?`
+
+	sqlDeleteAnnouncesBefore = `DELETE FROM announce WHERE created_at < ?`
+
+	sqlDeleteAnnounceHoursBefore = `DELETE FROM announce_hourly WHERE hour < ?`
+
+	// Nodes whose announce was rolled up are in announce_seen and aren't
+	// stored again.
+	sqlCreateAnnounce = `INSERT INTO announce (infoHash, peerID, ip, port, implied_port)
+			     SELECT ?, ?, ?, ?, ? WHERE NOT EXISTS (
+				SELECT 1 FROM announce_seen WHERE infoHash = ? AND peerID = ?)`
+
+	// announce_count counts distinct announcing nodes and is only bumped
+	// when the announce insert wasn't ignored as a repeat.
+	sqlUpdateAnnounceCount = `UPDATE torrent
+				  SET announce_count = announce_count + ?, raw_announce_count = raw_announce_count + 1,
+				  lookup_only = 0
+				  WHERE infoHash = ?`
+
+	// sqlRecountAnnounces recomputes distinct announcers from the announce
+	// table. Repeat announces were never stored, so the old announce_count,
+	// which counted every announce, is kept as the raw count.
+	sqlRecountAnnounces = `UPDATE torrent
+			       SET raw_announce_count = announce_count,
+			       announce_count = (SELECT count(*) FROM announce AS a WHERE a.infoHash = torrent.infoHash)`
 
-	sqlCreateAnnounce = `INSERT INTO announce (infoHash, peerID) VALUES (?,?)`
+	sqlCreateLookup = `INSERT INTO lookup (infoHash, nodeID) VALUES (?,?)`
 
-	sqlUpdateAnnounceCount = `UPDATE torrent SET announce_count = announce_count + 1 WHERE infoHash = ?`
+	sqlUpdateLookupCount = `UPDATE torrent SET lookup_count = lookup_count + 1 WHERE infoHash = ?`
+
+	// Resolved and dead hashes are never queued, unless their files are
+	// stale.
+	sqlEnqueueHash = `INSERT OR IGNORE INTO resolve_queue (infoHash)
+			  SELECT ? WHERE NOT EXISTS (
+				SELECT 1 FROM torrent
+				WHERE infoHash = ? AND ((resolved_at IS NOT NULL AND files_stale = 0) OR dead = 1))`
+
+	sqlTouchQueuedHash = `UPDATE resolve_queue SET seen_at = (strftime('%s', 'now')) WHERE infoHash = ?`
+
+	// Queued hashes are resolved most announced first, then most recently
+	// seen first. Hashes waiting out a retry backoff are skipped.
+	sqlNextQueuedHashes = `SELECT q.infoHash
+			       FROM resolve_queue AS q
+			       LEFT JOIN torrent AS t ON q.infoHash = t.infoHash
+			       WHERE q.started_at IS NULL
+			       AND (t.retry_at IS NULL OR t.retry_at <= strftime('%s', 'now'))
+			       ORDER BY t.announce_count DESC, q.seen_at DESC LIMIT ?`
+
+	sqlStartQueuedHash = `UPDATE resolve_queue SET started_at = (strftime('%s', 'now')) WHERE infoHash = ?`
+
+	sqlFinishQueuedHash = `DELETE FROM resolve_queue WHERE infoHash = ?`
+
+	sqlResetResolveQueue = `UPDATE resolve_queue SET started_at = NULL WHERE started_at IS NOT NULL`
+
+	sqlTrimResolveQueue = `DELETE FROM resolve_queue WHERE infoHash IN (
+				SELECT q.infoHash
+				FROM resolve_queue AS q
+				LEFT JOIN torrent AS t ON q.infoHash = t.infoHash
+				WHERE q.started_at IS NULL
+				ORDER BY t.announce_count DESC, q.seen_at DESC LIMIT -1 OFFSET ?)`
+
+	sqlHasFTS5 = `SELECT sqlite_compileoption_used('ENABLE_FTS5')`
+
+	sqlCreateSchemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version(
+				       version INTEGER PRIMARY KEY,
+				       description TEXT,
+				       applied_at DATE DEFAULT (strftime('%s', 'now')))`
+
+	sqlHasSchemaVersion = `SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`
+
+	sqlSchemaVersion = `SELECT coalesce(max(version), 0) FROM schema_version`
+
+	sqlRecordSchemaVersion = `INSERT INTO schema_version (version, description) VALUES (?, ?)`
+
+	sqlTableColumns = `PRAGMA table_info(%s)`
+
+	sqlAddColumn = `ALTER TABLE %s ADD COLUMN %s %s`
 
 	sqlSetTorrentMeta = `UPDATE torrent
-			     SET name = ?, length = ?, resolved_at = (strftime('%s', 'now'))
+			     SET name = ?, length = ?, piece_length = ?, file_count = ?, private = ?, source = ?,
+			     creation_date = ?, comment = ?, created_by = ?, category = ?, category_confidence = ?,
+			     title = ?, year = ?, season = ?, episode = ?, resolution = ?, codec = ?,
+			     release_source = ?, release_group = ?, resolved_at = (strftime('%s', 'now')),
+			     resolve_attempts = resolve_attempts + 1, last_attempt_at = (strftime('%s', 'now')),
+			     last_failure = NULL, retry_at = NULL, dead = 0, files_stale = 0
 			     WHERE infohash = ?`
 
-	sqlGetTorrent = `SELECT announce_count, infoHash, name, length, created_at, resolved_at
-			 FROM torrent WHERE infoHash = ?`
+	sqlSetCategory = `UPDATE torrent SET category = ?, category_confidence = ? WHERE infoHash = ?`
+
+	sqlSetRelease = `UPDATE torrent
+			 SET title = ?, year = ?, season = ?, episode = ?, resolution = ?, codec = ?,
+			 release_source = ?, release_group = ?
+			 WHERE infoHash = ?`
+
+	sqlResolvedNames = `SELECT infoHash, name FROM torrent WHERE resolved_at IS NOT NULL`
+
+	sqlUncategorizedTorrents = `SELECT infoHash, name, length FROM torrent WHERE resolved_at IS NOT NULL AND category IS NULL`
+
+	sqlResetEmptyCategories = `UPDATE torrent SET category = NULL
+				   WHERE resolved_at IS NOT NULL AND category = ? AND category_confidence = 0`
+
+	sqlCreateSwarmSample = `INSERT INTO swarm_sample (infoHash, sampled_at, peers, seeders, leechers) VALUES (?, ?, ?, ?, ?)`
+
+	sqlSetSwarm = `UPDATE torrent
+		       SET swarm_sampled_at = ?, swarm_peers = ?, swarm_seeders = ?, swarm_leechers = ?, swarm_size = ?
+		       WHERE infoHash = ?`
+
+	// swarm_failed_at is when the last swarm sample of a torrent failed,
+	// so it isn't picked again before the next sample is due.
+	sqlAddSwarmFailedAt = `ALTER TABLE torrent ADD COLUMN swarm_failed_at DATE DEFAULT NULL`
+
+	sqlSetSwarmFailed = `UPDATE torrent SET swarm_failed_at = ? WHERE infoHash = ?`
+
+	// Torrents due for a swarm sample, most popular first.
+	sqlSwarmSampleCandidates = `SELECT ` + sqlTorrentColumns + `
+				    FROM torrent AS t
+				    WHERE t.resolved_at IS NOT NULL AND t.dead = 0
+				    AND (t.swarm_sampled_at IS NULL OR t.swarm_sampled_at < ?)
+				    AND (t.swarm_failed_at IS NULL OR t.swarm_failed_at < ?)
+				    ORDER BY t.announce_count + t.lookup_count DESC LIMIT ?`
+
+	sqlAddTracker = `INSERT INTO torrent_tracker (infoHash, url) VALUES (?, ?)`
+
+	sqlGetTrackers = `SELECT url FROM torrent_tracker WHERE infoHash = ? ORDER BY rowid`
+
+	sqlCreateTrackerScrape = `INSERT INTO tracker_scrape (infoHash, tracker, scraped_at, seeders, leechers, completed)
+				  VALUES (?, ?, ?, ?, ?, ?)`
+
+	sqlSetTrackerScraped = `UPDATE torrent SET tracker_scraped_at = ? WHERE infoHash = ?`
+
+	sqlSetTrackerCounts = `UPDATE torrent
+			       SET tracker_seeders = ?, tracker_leechers = ?, tracker_completed = ?
+			       WHERE infoHash = ?`
+
+	// Torrents due for a tracker scrape, most popular first. Takes a filter
+	// on torrents with trackers of their own.
+	sqlTrackerScrapeCandidates = `SELECT t.infoHash
+				      FROM torrent AS t
+				      WHERE t.resolved_at IS NOT NULL AND t.dead = 0
+				      AND (t.tracker_scraped_at IS NULL OR t.tracker_scraped_at < ?) AND %s
+				      ORDER BY t.announce_count + t.lookup_count DESC LIMIT ?`
+
+	sqlRecordResolveFailure = `UPDATE torrent
+				   SET resolve_attempts = resolve_attempts + 1, last_attempt_at = (strftime('%s', 'now')),
+				   last_failure = ?, retry_at = ?, dead = ?
+				   WHERE infoHash = ?`
+
+	// sqlRecordResolveHint counts a hinted resolve attempt, and in
+	// resolved_with_hint the attempts that resolved.
+	sqlRecordResolveHint = `UPDATE torrent
+				SET hinted_attempts = hinted_attempts + 1, resolved_with_hint = resolved_with_hint + ?
+				WHERE infoHash = ?`
+
+	sqlGetTorrent = `SELECT ` + sqlTorrentColumns + `
+			 FROM torrent AS t WHERE t.infoHash = ?`
 
 	sqlGetFileInfo = `SELECT fi.path, fi.infohash, fi.length, fi.position
 			  FROM file_info AS fi
 			  WHERE fi.infohash = ?
 			  ORDER BY fi.position ASC`
 
-	sqlSearchTorrents = `SELECT t.announce_count, t.infoHash, t.name, t.length, t.created_at, t.resolved_at
-			     FROM search_torrent AS s
-			     INNER JOIN torrent AS t ON s.infoHash = t.infoHash
-			     WHERE s.name MATCH ?
-			     GROUP BY t.announce_count, t.infoHash, t.name, t.length, t.created_at, t.resolved_at
-			     ORDER BY t.announce_count DESC LIMIT ?`
+	sqlGetAnnouncers = `SELECT infoHash, peerID, ip, port, implied_port, created_at
+			    FROM announce
+			    WHERE infoHash = ?
+			    ORDER BY created_at DESC`
+
+	// sqlSearchTorrents keeps the best matching name or file path of each
+	// torrent, with the file it names. SQLite takes the bare name and
+	// position columns from the row chosen by max(). The ORDER BY stops
+	// SQLite flattening the match into the aggregate, where FTS5 can't run
+	// bm25. Takes the FTS5 query.
+	sqlSearchTorrents = `SELECT ` + sqlTorrentColumns + `, m.relevance, m.name, fi.path, fi.length, fi.position
+			     FROM (SELECT infoHash, max(relevance) AS relevance, name, position
+				   FROM (SELECT infoHash, position, -bm25(search_torrent) AS relevance, name
+					 FROM search_torrent WHERE search_torrent MATCH ?
+					 ORDER BY rank)
+				   GROUP BY infoHash) AS m
+			     INNER JOIN torrent AS t ON m.infoHash = t.infoHash
+			     LEFT JOIN file_info AS fi ON fi.infoHash = m.infoHash AND fi.position = m.position
+			     WHERE %s
+			     ORDER BY %s DESC LIMIT ?`
+
+	// sqlExcludeMatch is the SearchFilter condition leaving out torrents
+	// with a name or file path matching an FTS5 query.
+	sqlExcludeMatch = `t.infoHash NOT IN (SELECT infoHash FROM search_torrent
+			   WHERE search_torrent MATCH ?)`
+
+	// sqlFacetTorrents is sqlSearchTorrents for searches with only facets
+	// and no words to match.
+	sqlFacetTorrents = `SELECT ` + sqlTorrentColumns + `
+			    FROM torrent AS t
+			    WHERE t.resolved_at IS NOT NULL AND %s
+			    ORDER BY %s DESC LIMIT ?`
+
+	// sqlSearchTorrents, sqlFacetTorrents and sqlPopularTorrents take a
+	// SearchFilter condition and an ORDER BY expression. sqlPopularTorrents
+	// also takes a filter on dead torrents before the SearchFilter
+	// condition.
+	sqlPopularTorrents = `SELECT ` + sqlTorrentColumns + `
+			      FROM torrent AS t
+			      WHERE %s AND %s
+			      ORDER BY %s DESC LIMIT ?;`
+
+	// sqlAnnounceActivity lists the announces seen in a time range, repeats
+	// included, for sqlTimelineTorrents. Hourly counts and rollups count
+	// from the middle of their hour and day, so their ranges are shifted
+	// back by half an hour and half a day.
+	sqlAnnounceActivity = `SELECT infoHash, hour + 1800 AS seen, announces AS n
+			       FROM announce_hourly WHERE hour >= ? AND hour < ?
+			       UNION ALL
+			       SELECT infoHash, day + 43200 AS seen, announces AS n
+			       FROM announce_daily WHERE day >= ? AND day < ?`
 
-	sqlPopularTorrents = `SELECT announce_count, infoHash, name, length, created_at, resolved_at
-			      FROM torrent
-			      ORDER BY announce_count DESC LIMIT ?;`
+	// sqlAnnouncerActivity and sqlLookupActivity list the distinct
+	// announcers and the lookups seen in a time range, for
+	// sqlTimelineTorrents. announce only stores the first announce of a
+	// torrent by each node.
+	sqlAnnouncerActivity = `SELECT infoHash, created_at AS seen, 1 AS n
+			       FROM announce WHERE created_at >= ? AND created_at < ?
+			       UNION ALL
+			       SELECT infoHash, day + 43200 AS seen, announcers AS n
+			       FROM announce_daily WHERE day >= ? AND day < ?`
 
-	sqlPopularTorrentsDay = `SELECT announce_count, infoHash, name, length, created_at, resolved_at
-				 FROM torrent
-				 WHERE datetime(created_at, 'unixepoch') <= datetime('now', ?)
-				 AND datetime(created_at, 'unixepoch') > datetime('now', ?)
-				 ORDER BY announce_count DESC LIMIT ?`
+	sqlLookupActivity = `SELECT infoHash, created_at AS seen, 1 AS n
+			     FROM lookup WHERE created_at >= ? AND created_at < ?`
 
-	sqlTotalTorrents = `SELECT count(*) FROM torrent`
+	// sqlTimelineTorrents counts the activity of each torrent in each
+	// timeline bucket, numbered from the bucket origin by the bucket length,
+	// and keeps the top torrents of every bucket. Takes a score expression,
+	// an activity subquery and a SearchFilter condition, and the
+	// origin, length, activity arguments, filter arguments and per bucket
+	// limit.
+	sqlTimelineTorrents = `SELECT * FROM (
+				SELECT ` + sqlTorrentColumns + `, c.bucket, c.cnt,
+				row_number() OVER (PARTITION BY c.bucket ORDER BY %s DESC, t.infoHash) AS pos
+				FROM (SELECT (w.seen - ?) / ? AS bucket, w.infoHash, sum(w.n) AS cnt
+				      FROM (%s) AS w
+				      GROUP BY 1, 2) AS c
+				INNER JOIN torrent AS t ON c.infoHash = t.infoHash
+				WHERE %s) AS r
+			       WHERE r.pos <= ?
+			       ORDER BY r.bucket DESC, r.pos`
+
+	// sqlAnnounceHistory counts the announces and announcers of a torrent
+	// in each bucket, like sqlTimelineTorrents. Announces are counted from
+	// announce_hourly in the middle of their hour, and announcers from
+	// announce, where each stored announce is from a distinct announcer.
+	// Takes the bucket origin and length, then the hash and time range for
+	// announce_hourly, announce and announce_daily.
+	sqlAnnounceHistory = `SELECT (w.seen - ?) / ? AS bucket, sum(w.announces), sum(w.announcers)
+			      FROM (SELECT hour + 1800 AS seen, announces, 0 AS announcers
+				    FROM announce_hourly WHERE infoHash = ? AND hour >= ? AND hour < ?
+				    UNION ALL
+				    SELECT created_at AS seen, 0 AS announces, 1 AS announcers
+				    FROM announce WHERE infoHash = ? AND created_at >= ? AND created_at < ?
+				    UNION ALL
+				    SELECT day + 43200 AS seen, announces, announcers
+				    FROM announce_daily WHERE infoHash = ? AND day >= ? AND day < ?) AS w
+			      GROUP BY 1`
+
+	// sqlTrendingTorrents counts the announces of each torrent in the trend
+	// window and the one before it, repeats included, from both hourly
+	// counts and daily rollups, which count from the middle of their hour
+	// and day. decayed weights announces in the window from 0 at its start
+	// to 1 now, like trendWindow.add. Takes a SearchFilter condition, a
+	// TrendView condition and score expression, then the window start four
+	// times, the window length, the previous window start twice and the
+	// SearchFilter arguments.
+	sqlTrendingTorrents = `SELECT ` + sqlTorrentColumns + `, a.cur, a.prev, a.decayed
+			       FROM (SELECT w.infoHash,
+				     sum(CASE WHEN w.seen > ? THEN w.n ELSE 0 END) AS cur,
+				     sum(CASE WHEN w.seen > ? THEN 0 ELSE w.n END) AS prev,
+				     sum(CASE WHEN w.seen > ? THEN w.n * (w.seen - ?) ELSE 0 END) * 1.0 / ? AS decayed
+				     FROM (SELECT infoHash, hour + 1800 AS seen, announces AS n
+					   FROM announce_hourly WHERE hour + 1800 > ?
+					   UNION ALL
+					   SELECT infoHash, day + 43200 AS seen, announces AS n
+					   FROM announce_daily WHERE day + 43200 > ?) AS w
+				     GROUP BY w.infoHash) AS a
+			       INNER JOIN torrent AS t ON a.infoHash = t.infoHash
+			       WHERE %s AND %s
+			       ORDER BY %s DESC, t.infoHash LIMIT ?`
+
+	sqlUnresolvedTorrents = `SELECT ` + sqlTorrentColumns + `
+				 FROM torrent AS t
+				 WHERE t.resolved_at IS NULL AND t.resolve_attempts > 0 AND %s
+				 ORDER BY t.dead DESC, t.resolve_attempts DESC, t.announce_count DESC LIMIT ?`
+
+	sqlTotalTorrents = `SELECT count(*) FROM torrent WHERE lookup_only = 0`
+
+	sqlTotalLookupOnly = `SELECT count(*) FROM torrent WHERE lookup_only = 1`
 
 	sqlTotalResolved = `SELECT count(*) FROM torrent WHERE resolved_at IS NOT NULL`
 
-	sqlTotalAnnounces = `SELECT count(*) FROM announce`
+	sqlTotalAnnounces = `SELECT (SELECT count(*) FROM announce) +
+			     (SELECT coalesce(sum(announcers), 0) FROM announce_daily)`
+
+	sqlTotalLookups = `SELECT count(*) FROM lookup`
+
+	sqlTotalHinted = `SELECT coalesce(sum(hinted_attempts), 0), coalesce(sum(resolved_with_hint), 0) FROM torrent`
+
+	sqlTotalRawAnnounces = `SELECT coalesce(sum(raw_announce_count), 0) FROM torrent`
+
+	sqlTotalSwarmSamples = `SELECT count(*) FROM swarm_sample`
+
+	sqlTotalTrackerScrapes = `SELECT count(*) FROM tracker_scrape`
+
+	sqlTotalQueued = `SELECT count(*) FROM resolve_queue`
+
+	sqlTotalAnnounceIPs = `SELECT count(DISTINCT ip) FROM announce WHERE ip IS NOT NULL`
 )
@@ -0,0 +1,205 @@
+package server
+
+// Postgres versions of the SQLite tables in sql.go. Dates are stored as unix
+// seconds, like SQLite, and booleans as integers.
+const (
+	pgCreateTorrentTable = `CREATE TABLE IF NOT EXISTS torrent(
+				infoHash TEXT PRIMARY KEY,
+				name TEXT DEFAULT NULL,
+				length BIGINT DEFAULT 0,
+				resolved_at BIGINT DEFAULT NULL,
+				created_at BIGINT DEFAULT extract(epoch from now())::bigint,
+				announce_count INTEGER DEFAULT 0,
+				lookup_count INTEGER DEFAULT 0,
+				resolve_attempts INTEGER DEFAULT 0,
+				last_attempt_at BIGINT DEFAULT NULL,
+				last_failure TEXT DEFAULT NULL,
+				retry_at BIGINT DEFAULT NULL,
+				dead INTEGER DEFAULT 0,
+				hinted_attempts INTEGER DEFAULT 0,
+				resolved_with_hint INTEGER DEFAULT 0,
+				raw_announce_count INTEGER DEFAULT 0,
+				piece_length BIGINT DEFAULT 0,
+				file_count INTEGER DEFAULT 0,
+				private INTEGER DEFAULT 0,
+				source TEXT DEFAULT NULL,
+				creation_date BIGINT DEFAULT NULL,
+				comment TEXT DEFAULT NULL,
+				created_by TEXT DEFAULT NULL,
+				category TEXT DEFAULT NULL,
+				category_confidence DOUBLE PRECISION DEFAULT 0,
+				title TEXT DEFAULT NULL,
+				year INTEGER DEFAULT 0,
+				season INTEGER DEFAULT 0,
+				episode INTEGER DEFAULT 0,
+				resolution TEXT DEFAULT NULL,
+				codec TEXT DEFAULT NULL,
+				release_source TEXT DEFAULT NULL,
+				release_group TEXT DEFAULT NULL,
+				swarm_sampled_at BIGINT DEFAULT NULL,
+				swarm_peers INTEGER DEFAULT 0,
+				swarm_seeders INTEGER DEFAULT NULL,
+				swarm_leechers INTEGER DEFAULT NULL,
+				swarm_size INTEGER DEFAULT 0,
+				tracker_scraped_at BIGINT DEFAULT NULL,
+				tracker_seeders INTEGER DEFAULT 0,
+				tracker_leechers INTEGER DEFAULT 0,
+				tracker_completed INTEGER DEFAULT 0)`
+
+	pgCreateFileInfoTable = `CREATE TABLE IF NOT EXISTS file_info(
+				 infoHash TEXT,
+				 length BIGINT,
+				 position INTEGER,
+				 path TEXT)`
+
+	pgCreateFileInfoIndex = `CREATE INDEX IF NOT EXISTS file_info_hash ON file_info(infoHash)`
+
+	pgCreateAnnounceTable = `CREATE TABLE IF NOT EXISTS announce(
+				 infoHash TEXT,
+				 peerID TEXT,
+				 created_at BIGINT DEFAULT extract(epoch from now())::bigint,
+				 ip TEXT DEFAULT NULL,
+				 port INTEGER DEFAULT 0,
+				 implied_port INTEGER DEFAULT 0,
+				 UNIQUE(infoHash, peerID))`
+
+	pgCreateLookupTable = `CREATE TABLE IF NOT EXISTS lookup(
+			       infoHash TEXT,
+			       nodeID TEXT,
+			       created_at BIGINT DEFAULT extract(epoch from now())::bigint)`
+
+	pgCreateResolveQueueTable = `CREATE TABLE IF NOT EXISTS resolve_queue(
+				     infoHash TEXT PRIMARY KEY,
+				     queued_at BIGINT DEFAULT extract(epoch from now())::bigint,
+				     seen_at BIGINT DEFAULT extract(epoch from now())::bigint,
+				     started_at BIGINT DEFAULT NULL)`
+
+	pgCreateTorrentInfoTable = `CREATE TABLE IF NOT EXISTS torrent_info(
+				    infoHash TEXT PRIMARY KEY,
+				    info BYTEA)`
+
+	pgCreateSwarmSampleTable = `CREATE TABLE IF NOT EXISTS swarm_sample(
+				    infoHash TEXT,
+				    sampled_at BIGINT,
+				    peers INTEGER DEFAULT 0,
+				    seeders INTEGER DEFAULT NULL,
+				    leechers INTEGER DEFAULT NULL)`
+
+	pgCreateTorrentTrackerTable = `CREATE TABLE IF NOT EXISTS torrent_tracker(
+				       id SERIAL PRIMARY KEY,
+				       infoHash TEXT,
+				       url TEXT,
+				       UNIQUE(infoHash, url))`
+
+	pgCreateTrackerScrapeTable = `CREATE TABLE IF NOT EXISTS tracker_scrape(
+				      infoHash TEXT,
+				      tracker TEXT,
+				      scraped_at BIGINT,
+				      seeders INTEGER DEFAULT 0,
+				      leechers INTEGER DEFAULT 0,
+				      completed INTEGER DEFAULT 0)`
+
+	// search_torrent is matched with a full text query on its name.
+	pgCreateSearchTable = `CREATE TABLE IF NOT EXISTS search_torrent(
+			       infoHash TEXT,
+			       name TEXT)`
+
+	pgCreateSearchIndex = `CREATE INDEX IF NOT EXISTS search_torrent_name
+			       ON search_torrent USING GIN (to_tsvector('simple', name))`
+
+	// Since schema version 2 search_torrent stores each name once, with the
+	// position of the file_info row it names. Names are unique by hash as
+	// long file paths don't fit in an index.
+	pgAddSearchPosition = `ALTER TABLE search_torrent ADD COLUMN IF NOT EXISTS position INTEGER DEFAULT NULL`
+
+	pgDeleteDuplicateSearchNames = `DELETE FROM search_torrent AS a USING search_torrent AS b
+					WHERE a.ctid > b.ctid AND a.infoHash = b.infoHash AND a.name = b.name`
+
+	pgLinkSearchFiles = `UPDATE search_torrent AS s SET position = fi.position
+			     FROM file_info AS fi
+			     WHERE fi.infoHash = s.infoHash AND fi.path = s.name`
+
+	pgCreateSearchNameIndex = `CREATE UNIQUE INDEX IF NOT EXISTS search_torrent_hash_name
+				   ON search_torrent(infoHash, md5(name))`
+
+	pgCreateSchemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version(
+				      version INTEGER PRIMARY KEY,
+				      description TEXT,
+				      applied_at BIGINT DEFAULT extract(epoch from now())::bigint)`
+)
+
+// postgresQueries are the Postgres versions of SQLite queries that
+// postgresReplacer can't translate.
+var postgresQueries = map[string]string{
+	sqlCreateSchemaVersionTable: pgCreateSchemaVersionTable,
+
+	sqlHasSchemaVersion: `SELECT count(*) FROM information_schema.tables
+			      WHERE table_schema = current_schema() AND table_name = 'schema_version'`,
+
+	sqlCreateTorrent: sqlCreateTorrent + ` ON CONFLICT DO NOTHING`,
+
+	sqlAddSwarmFailedAt: `ALTER TABLE torrent ADD COLUMN IF NOT EXISTS swarm_failed_at BIGINT DEFAULT NULL`,
+
+	sqlCreateLookupTorrent: sqlCreateLookupTorrent + ` ON CONFLICT DO NOTHING`,
+
+	sqlCreateAnnounceDailyTable: `CREATE TABLE IF NOT EXISTS announce_daily(
+				      infoHash TEXT,
+				      day BIGINT,
+				      announces INTEGER DEFAULT 0,
+				      announcers INTEGER DEFAULT 0,
+				      PRIMARY KEY(infoHash, day))`,
+
+	sqlCreateAnnounceHourlyTable: `CREATE TABLE IF NOT EXISTS announce_hourly(
+				       infoHash TEXT,
+				       hour BIGINT,
+				       announces INTEGER DEFAULT 0,
+				       PRIMARY KEY(infoHash, hour))`,
+
+	sqlCreateTorrentSearch: `INSERT INTO search_torrent (infoHash, name, position) VALUES (?, ?, ?)
+				 ON CONFLICT DO NOTHING`,
+
+	// ts_rank stands in for bm25, and DISTINCT ON keeps the best match of
+	// each torrent.
+	sqlSearchTorrents: `SELECT ` + sqlTorrentColumns + `, m.relevance, m.name, fi.path, fi.length, fi.position
+			    FROM (SELECT DISTINCT ON (s.infoHash) s.infoHash, s.position, s.name,
+				  ts_rank(to_tsvector('simple', s.name), q) AS relevance
+				  FROM search_torrent AS s, plainto_tsquery('simple', ?) AS q
+				  WHERE to_tsvector('simple', s.name) @@ q
+				  ORDER BY s.infoHash, relevance DESC) AS m
+			    INNER JOIN torrent AS t ON m.infoHash = t.infoHash
+			    LEFT JOIN file_info AS fi ON fi.infoHash = m.infoHash AND fi.position = m.position
+			    WHERE %s
+			    ORDER BY %s DESC LIMIT ?`,
+
+	sqlCreateAnnounce: `INSERT INTO announce (infoHash, peerID, ip, port, implied_port)
+			    SELECT CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS INTEGER), CAST(? AS INTEGER)
+			    WHERE NOT EXISTS (
+				SELECT 1 FROM announce_seen WHERE infoHash = ? AND peerID = ?)
+			    ON CONFLICT DO NOTHING`,
+
+	sqlCreateAnnounceSeenTable: `CREATE TABLE IF NOT EXISTS announce_seen(
+				     infoHash TEXT,
+				     peerID TEXT,
+				     PRIMARY KEY(infoHash, peerID))`,
+
+	sqlMarkAnnouncesSeen: `INSERT INTO announce_seen (infoHash, peerID)
+			       SELECT infoHash, peerID FROM announce WHERE created_at < ?
+			       ON CONFLICT DO NOTHING`,
+
+	sqlAddTracker: sqlAddTracker + ` ON CONFLICT DO NOTHING`,
+
+	sqlSetTorrentInfo: `INSERT INTO torrent_info (infoHash, info) VALUES (?, ?)
+			    ON CONFLICT (infoHash) DO UPDATE SET info = excluded.info`,
+
+	sqlEnqueueHash: `INSERT INTO resolve_queue (infoHash)
+			 SELECT CAST(? AS TEXT) WHERE NOT EXISTS (
+				SELECT 1 FROM torrent
+				WHERE infoHash = ? AND ((resolved_at IS NOT NULL AND files_stale = 0) OR dead = 1))
+			 ON CONFLICT DO NOTHING`,
+
+	sqlDeleteTorrentSearch: `DELETE FROM search_torrent WHERE infoHash = ?`,
+
+	sqlEnqueueFilesStale: `INSERT INTO resolve_queue (infoHash)
+			       SELECT infoHash FROM torrent WHERE files_stale = 1
+			       ON CONFLICT DO NOTHING`,
+}
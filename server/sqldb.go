@@ -0,0 +1,150 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// dialect translates the SQLite queries in sql.go, and their arguments, for
+// the database behind a sqlDB. Queries taking fmt verbs are translated with
+// template before they are formatted.
+type dialect interface {
+	template(q string) string
+	query(q string) string
+	args(args []interface{}) []interface{}
+}
+
+// sqliteDialect runs queries as written.
+type sqliteDialect struct{}
+
+func (sqliteDialect) template(q string) string {
+	return q
+}
+
+func (sqliteDialect) query(q string) string {
+	return q
+}
+
+func (sqliteDialect) args(args []interface{}) []interface{} {
+	return args
+}
+
+// sqlDB is a database/sql database that translates queries with its
+// dialect.
+type sqlDB struct {
+	db *sql.DB
+	d  dialect
+}
+
+// sprintf formats the query template q for the dialect.
+func (me *sqlDB) sprintf(q string, a ...interface{}) string {
+	return fmt.Sprintf(me.d.template(q), a...)
+}
+
+func (me *sqlDB) Exec(q string, args ...interface{}) (sql.Result, error) {
+	return me.db.Exec(me.d.query(q), me.d.args(args)...)
+}
+
+func (me *sqlDB) Query(q string, args ...interface{}) (*sql.Rows, error) {
+	return me.db.Query(me.d.query(q), me.d.args(args)...)
+}
+
+func (me *sqlDB) QueryRow(q string, args ...interface{}) *sql.Row {
+	return me.db.QueryRow(me.d.query(q), me.d.args(args)...)
+}
+
+func (me *sqlDB) Begin() (*sqlTx, error) {
+	tx, err := me.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{tx, me.d}, nil
+}
+
+func (me *sqlDB) Close() error {
+	return me.db.Close()
+}
+
+// sqlTx is a transaction on a sqlDB.
+type sqlTx struct {
+	tx *sql.Tx
+	d  dialect
+}
+
+func (me *sqlTx) Exec(q string, args ...interface{}) (sql.Result, error) {
+	return me.tx.Exec(me.d.query(q), me.d.args(args)...)
+}
+
+func (me *sqlTx) Query(q string, args ...interface{}) (*sql.Rows, error) {
+	return me.tx.Query(me.d.query(q), me.d.args(args)...)
+}
+
+func (me *sqlTx) QueryRow(q string, args ...interface{}) *sql.Row {
+	return me.tx.QueryRow(me.d.query(q), me.d.args(args)...)
+}
+
+func (me *sqlTx) Prepare(q string) (*sqlStmt, error) {
+	st, err := me.tx.Prepare(me.d.query(q))
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStmt{st, me.d}, nil
+}
+
+func (me *sqlTx) Commit() error {
+	return me.tx.Commit()
+}
+
+func (me *sqlTx) Rollback() error {
+	return me.tx.Rollback()
+}
+
+// sqlStmt is a statement prepared in a sqlTx.
+type sqlStmt struct {
+	st *sql.Stmt
+	d  dialect
+}
+
+func (me *sqlStmt) Exec(args ...interface{}) (sql.Result, error) {
+	return me.st.Exec(me.d.args(args)...)
+}
+
+func (me *sqlStmt) Close() error {
+	return me.st.Close()
+}
+
+// sqlQueryer is implemented by both *sqlDB and *sqlTx.
+type sqlQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// dbTime scans a date stored as unix seconds. The SQLite driver returns
+// DATE columns as a time.Time while Postgres returns the integer. NULL scans
+// as the zero time.
+type dbTime time.Time
+
+func (me *dbTime) Scan(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		*me = dbTime{}
+	case time.Time:
+		*me = dbTime(v)
+	case int64:
+		*me = dbTime(time.Unix(v, 0))
+	case []byte:
+		return me.Scan(string(v))
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid date: %q", v)
+		}
+		*me = dbTime(time.Unix(n, 0))
+	default:
+		return fmt.Errorf("Invalid date: %v", v)
+	}
+	return nil
+}
@@ -3,138 +3,606 @@ package server
 import (
 	"database/sql"
 	"fmt"
-	"log"
-	"path/filepath"
 	"strings"
 	"time"
 )
 
+// sqlClient is a Store on a database/sql database. The queries in sql.go
+// are written for SQLite and translated for other databases by the db's
+// dialect.
+type sqlClient struct {
+	db         *sqlDB
+	migrations []Migration
+}
+
+// SqliteDBClient is a Store in a SQLite database file.
 type SqliteDBClient struct {
-	db *sql.DB
+	sqlClient
 }
 
+// FileInfo is a file in a resolved torrent. Path is the full path within the
+// torrent, with components joined by "/".
 type FileInfo struct {
 	Path     string
 	Length   int64
-	Index    int8
+	Index    int
 	InfoHash string
 }
 
+// Torrent is an indexed infohash. AnnounceCount is the number of distinct
+// DHT nodes that announced it and RawAnnounceCount every announce including
+// repeats. The embedded TorrentMeta is empty until the torrent is resolved.
 type Torrent struct {
-	AnnounceCount int
-	Name          string
-	InfoHash      string
-	Length        int64
-	CreatedAt     time.Time
-	ResolvedAt    time.Time
+	TorrentMeta
+	AnnounceCount    int
+	RawAnnounceCount int
+	LookupCount      int
+	InfoHash         string
+	CreatedAt        time.Time
+	ResolvedAt       time.Time
+	ResolveAttempts  int
+	LastAttemptAt    time.Time
+	LastFailure      string
+	Dead             bool
+	// FilesStale is set for torrents resolved before file paths were stored
+	// whole, whose files are queued to be resolved again.
+	FilesStale bool
+	// Swarm is the latest swarm sample, zero if it hasn't been sampled.
+	Swarm SwarmSample
+	// Tracker holds the highest seeder count from the latest tracker
+	// scrape, zero if it hasn't been scraped.
+	Tracker TrackerScrape
+}
+
+// SwarmSample is a DHT get_peers estimate of a torrent's swarm. Peers counts
+// the distinct peers returned. Seeders and Leechers are estimated from BEP 33
+// scrape bloom filters and are only set if Scraped.
+type SwarmSample struct {
+	SampledAt time.Time
+	Peers     int
+	Seeders   int
+	Leechers  int
+	Scraped   bool
+}
+
+// Size is the best estimate of the swarm size: the larger of the peers seen
+// and the scraped seeders and leechers.
+func (s SwarmSample) Size() int {
+	if s.Scraped && s.Seeders+s.Leechers > s.Peers {
+		return s.Seeders + s.Leechers
+	}
+	return s.Peers
+}
+
+// Rank returns the score m uses to order t, counting announces with c.
+func (t Torrent) Rank(m RankMode, c AnnounceCounter) int {
+	announces := t.AnnounceCount
+	if c == CountRaw {
+		announces = t.RawAnnounceCount
+	}
+	switch m {
+	case RankDemand:
+		return t.LookupCount
+	case RankCombined:
+		return announces + t.LookupCount
+	case RankSwarm:
+		return t.Swarm.Size()
+	default:
+		return announces
+	}
+}
+
+// TorrentMeta is the metadata stored for a resolved torrent. FileCount is 1
+// for single-file torrents. CreationDate, Comment and CreatedBy live outside
+// the info dictionary, so they are only known for torrents added from a
+// .torrent file and are empty for hashes resolved from the DHT.
+type TorrentMeta struct {
+	Name         string
+	Length       int64
+	PieceLength  int64
+	FileCount    int
+	Private      bool
+	Source       string
+	CreationDate time.Time
+	Comment      string
+	CreatedBy    string
+	// Category is classified from the torrent's files, with a
+	// CategoryConfidence between 0 and 1.
+	Category           Category
+	CategoryConfidence float64
+	// Release is parsed from Name when the metadata is stored.
+	Release Release
+}
+
+// SearchFilter narrows search results on torrent metadata. A zero
+// SearchFilter matches every torrent.
+type SearchFilter struct {
+	NoPrivate  bool
+	SingleFile bool
+	MultiFile  bool
+	Source     string
+	Category   Category
+	// Release facets, set from search terms like "year:2019 res:1080p".
+	Year          int
+	Season        int
+	Episode       int
+	Resolution    string
+	Codec         string
+	ReleaseSource string
+	Group         string
+	// Query fields, set from search terms like "size:>1GB ext:iso -beta".
+	// Size is in bytes and Announces are counted with the AnnounceCounter
+	// of the query. After and Before compare with when a torrent was first
+	// seen. Torrents need a file with one of Extensions and no name or file
+	// path containing a word or phrase of Exclude.
+	Size       Range
+	Announces  Range
+	After      time.Time
+	Before     time.Time
+	Extensions []string
+	Exclude    []string
+}
+
+// where returns the SQL condition for f and its arguments, counting
+// announces with c.
+func (f SearchFilter) where(c AnnounceCounter) (string, []interface{}) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+	if f.NoPrivate {
+		conds = append(conds, "t.private = 0")
+	}
+	if f.SingleFile {
+		conds = append(conds, "t.file_count = 1")
+	}
+	if f.MultiFile {
+		conds = append(conds, "t.file_count > 1")
+	}
+	if f.Source != "" {
+		conds = append(conds, "t.source = ?")
+		args = append(args, f.Source)
+	}
+	if f.Category != "" {
+		conds = append(conds, "t.category = ?")
+		args = append(args, string(f.Category))
+	}
+	ints := []struct {
+		col string
+		v   int
+	}{{"t.year", f.Year}, {"t.season", f.Season}, {"t.episode", f.Episode}}
+	for _, c := range ints {
+		if c.v != 0 {
+			conds = append(conds, c.col+" = ?")
+			args = append(args, c.v)
+		}
+	}
+	strs := []struct {
+		col string
+		v   string
+	}{{"t.resolution", f.Resolution}, {"t.codec", f.Codec}, {"t.release_source", f.ReleaseSource}, {"t.release_group", f.Group}}
+	for _, c := range strs {
+		if c.v != "" {
+			conds = append(conds, "lower("+c.col+") = lower(?)")
+			args = append(args, c.v)
+		}
+	}
+	conds, args = f.Size.where("t.length", conds, args)
+	conds, args = f.Announces.where(c.column(), conds, args)
+	if !f.After.IsZero() {
+		conds = append(conds, "t.created_at >= ?")
+		args = append(args, f.After.Unix())
+	}
+	if !f.Before.IsZero() {
+		conds = append(conds, "t.created_at < ?")
+		args = append(args, f.Before.Unix())
+	}
+	if len(f.Extensions) > 0 {
+		likes := make([]string, len(f.Extensions))
+		for i, e := range f.Extensions {
+			likes[i] = "lower(fi.path) LIKE ?"
+			args = append(args, "%."+e)
+		}
+		conds = append(conds, `EXISTS (SELECT 1 FROM file_info AS fi
+				WHERE fi.infoHash = t.infoHash AND (`+strings.Join(likes, " OR ")+`))`)
+	}
+	for _, e := range f.Exclude {
+		conds = append(conds, sqlExcludeMatch)
+		args = append(args, ftsQuery([]string{e}))
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// match reports if t passes the conditions of f on its metadata, counting
+// announces with c, like where.
+func (f SearchFilter) match(t Torrent, c AnnounceCounter) bool {
+	r := t.Release
+	switch {
+	case f.NoPrivate && t.Private,
+		f.SingleFile && t.FileCount != 1,
+		f.MultiFile && t.FileCount <= 1,
+		f.Source != "" && t.Source != f.Source,
+		f.Category != "" && t.Category != f.Category,
+		f.Year != 0 && r.Year != f.Year,
+		f.Season != 0 && r.Season != f.Season,
+		f.Episode != 0 && r.Episode != f.Episode,
+		f.Resolution != "" && !strings.EqualFold(r.Resolution, f.Resolution),
+		f.Codec != "" && !strings.EqualFold(r.Codec, f.Codec),
+		f.ReleaseSource != "" && !strings.EqualFold(r.Source, f.ReleaseSource),
+		f.Group != "" && !strings.EqualFold(r.Group, f.Group),
+		!f.Size.contains(t.Length),
+		!f.Announces.contains(int64(t.Rank(RankSupply, c))),
+		!f.After.IsZero() && t.CreatedAt.Before(f.After),
+		!f.Before.IsZero() && !t.CreatedAt.Before(f.Before):
+		return false
+	}
+	return true
+}
+
+// matchFiles reports if one of paths has an extension in f, like the
+// file_info condition of where.
+func (f SearchFilter) matchFiles(paths []string) bool {
+	if len(f.Extensions) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		for _, e := range f.Extensions {
+			if strings.HasSuffix(strings.ToLower(p), "."+e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchNames reports if none of the search names of a torrent match a
+// word or phrase f excludes, like sqlExcludeMatch.
+func (f SearchFilter) matchNames(names []string) bool {
+	for _, term := range parseQueryTerms(f.Exclude) {
+		for _, n := range names {
+			if term.in(searchTokens(n)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Announce is an announce_peer query to be stored.
+type Announce struct {
+	InfoHash    string
+	PeerID      string
+	IP          string
+	Port        int
+	ImpliedPort bool
 }
 
+// Lookup is a get_peers query to be stored.
+type Lookup struct {
+	InfoHash string
+	NodeID   string
+}
+
+// IngestBatch is a group of writes committed in a single transaction. Queue
+// holds hashes to add to the resolve queue. A torrent is created for every
+// hash in the batch.
+type IngestBatch struct {
+	Announces []Announce
+	Lookups   []Lookup
+	Queue     []string
+}
+
+// Stats are totals of the index. Announces includes announces rolled up by
+// RollupAnnounces, while AnnounceIPs only counts those still stored.
+// Torrents leaves out the hashes only seen in lookups, which are counted in
+// LookupOnly.
 type Stats struct {
-	Torrents  int64
-	Announces int64
-	Resolved  int64
+	Torrents     int64
+	LookupOnly   int64
+	Announces    int64
+	RawAnnounces int64
+	AnnounceIPs  int64
+	Lookups      int64
+	Resolved     int64
+	Queued       int64
+	SwarmSamples int64
+	// TrackerScrapes counts successful tracker scrapes.
+	TrackerScrapes int64
+	// HintedAttempts counts resolve attempts that were given announcer
+	// endpoints as initial peers, and HintedResolves how many of those
+	// succeeded.
+	HintedAttempts int64
+	HintedResolves int64
+}
+
+// Announcer is the DHT node and endpoint that announced a torrent. IP is
+// empty when announcer IPs are dropped and a keyed hash of the address when
+// they are hashed. Port is the torrent port the announcer asked for, which is
+// the DHT source port when ImpliedPort is set.
+type Announcer struct {
+	InfoHash    string
+	PeerID      string
+	IP          string
+	Port        int
+	ImpliedPort bool
+	CreatedAt   time.Time
+}
+
+// RankMode selects which DHT signal is used to rank torrents. Announces
+// (announce_peer) show what peers are sharing, lookups (get_peers) show what
+// peers are searching for.
+type RankMode int
+
+const (
+	// RankSupply ranks torrents by announce count.
+	RankSupply RankMode = iota
+	// RankDemand ranks torrents by lookup count.
+	RankDemand
+	// RankCombined ranks torrents by the sum of announce and lookup counts.
+	RankCombined
+	// RankSwarm ranks torrents by their latest sampled swarm size.
+	RankSwarm
+)
+
+var rankModeNames = map[RankMode]string{
+	RankSupply:   "supply",
+	RankDemand:   "demand",
+	RankCombined: "combined",
+	RankSwarm:    "swarm",
 }
 
-type TimelineEntry struct {
-	Day      time.Time
-	Torrents []Torrent
+// ParseRankMode returns the RankMode named s.
+func ParseRankMode(s string) (RankMode, error) {
+	for m, n := range rankModeNames {
+		if n == s {
+			return m, nil
+		}
+	}
+	return RankSupply, fmt.Errorf("Unknown rank mode: %s", s)
+}
+
+func (m RankMode) String() string {
+	return rankModeNames[m]
+}
+
+func (m RankMode) orderBy(c AnnounceCounter) string {
+	switch m {
+	case RankDemand:
+		return "t.lookup_count"
+	case RankCombined:
+		return c.column() + " + t.lookup_count"
+	case RankSwarm:
+		return "t.swarm_size"
+	default:
+		return c.column()
+	}
+}
+
+// AnnounceCounter selects how announces are counted when ranking torrents.
+// CountDistinct counts each announcing DHT node once, while CountRaw counts
+// every announce, rewarding nodes that re-announce.
+type AnnounceCounter int
+
+const (
+	// CountDistinct counts distinct announcing nodes.
+	CountDistinct AnnounceCounter = iota
+	// CountRaw counts every announce.
+	CountRaw
+)
+
+var announceCounterNames = map[AnnounceCounter]string{
+	CountDistinct: "distinct",
+	CountRaw:      "raw",
 }
 
-func scanTorrent(scan func(...interface{}) error) (Torrent, error) {
+// ParseAnnounceCounter returns the AnnounceCounter named s.
+func ParseAnnounceCounter(s string) (AnnounceCounter, error) {
+	for c, n := range announceCounterNames {
+		if n == s {
+			return c, nil
+		}
+	}
+	return CountDistinct, fmt.Errorf("Unknown announce counter: %s", s)
+}
+
+func (c AnnounceCounter) String() string {
+	return announceCounterNames[c]
+}
+
+func (c AnnounceCounter) column() string {
+	if c == CountRaw {
+		return "t.raw_announce_count"
+	}
+	return "t.announce_count"
+}
+
+// scanTorrent scans the sqlTorrentColumns of a row, followed by any extra
+// columns.
+func scanTorrent(scan func(...interface{}) error, extra ...interface{}) (Torrent, error) {
 	st := struct {
-		AnnounceCount int
-		Name          *string
-		InfoHash      string
-		Length        int64
-		CreatedAt     *time.Time
-		ResolvedAt    *time.Time
+		AnnounceCount   int
+		Name            *string
+		InfoHash        string
+		Length          int64
+		CreatedAt       dbTime
+		ResolvedAt      dbTime
+		LookupCount     int
+		ResolveAttempts int
+		LastAttemptAt   dbTime
+		LastFailure     *string
+		Dead            bool
+		RawAnnounces    int
+		PieceLength     int64
+		FileCount       int
+		Private         bool
+		Source          *string
+		CreationDate    dbTime
+		Comment         *string
+		CreatedBy       *string
+		Category        *string
+		CategoryConf    float64
+		Title           *string
+		Resolution      *string
+		Codec           *string
+		ReleaseSource   *string
+		ReleaseGroup    *string
+		SwarmSampledAt  dbTime
+		SwarmPeers      int
+		SwarmSeeders    *int
+		SwarmLeechers   *int
+		TrackerScraped  dbTime
+		TrackerCounts   [3]int
+		FilesStale      bool
 	}{}
+	var r Release
 
-	err := scan(&st.AnnounceCount, &st.InfoHash, &st.Name, &st.Length, &st.CreatedAt, &st.ResolvedAt)
+	dest := []interface{}{&st.AnnounceCount, &st.InfoHash, &st.Name, &st.Length, &st.CreatedAt, &st.ResolvedAt,
+		&st.LookupCount, &st.ResolveAttempts, &st.LastAttemptAt, &st.LastFailure, &st.Dead, &st.RawAnnounces,
+		&st.PieceLength, &st.FileCount, &st.Private, &st.Source, &st.CreationDate, &st.Comment, &st.CreatedBy,
+		&st.Category, &st.CategoryConf, &st.Title, &r.Year, &r.Season, &r.Episode,
+		&st.Resolution, &st.Codec, &st.ReleaseSource, &st.ReleaseGroup,
+		&st.SwarmSampledAt, &st.SwarmPeers, &st.SwarmSeeders, &st.SwarmLeechers,
+		&st.TrackerScraped, &st.TrackerCounts[0], &st.TrackerCounts[1], &st.TrackerCounts[2],
+		&st.FilesStale}
+	err := scan(append(dest, extra...)...)
 	if err != nil {
 		return Torrent{}, err
 	}
 
 	t := Torrent{
-		AnnounceCount: st.AnnounceCount,
-		InfoHash:      st.InfoHash,
-		Length:        st.Length,
+		AnnounceCount:    st.AnnounceCount,
+		RawAnnounceCount: st.RawAnnounces,
+		LookupCount:      st.LookupCount,
+		InfoHash:         st.InfoHash,
+		ResolveAttempts:  st.ResolveAttempts,
+		Dead:             st.Dead,
+		FilesStale:       st.FilesStale,
+		CreatedAt:        time.Time(st.CreatedAt),
+		ResolvedAt:       time.Time(st.ResolvedAt),
+		LastAttemptAt:    time.Time(st.LastAttemptAt),
 	}
+	t.CreationDate = time.Time(st.CreationDate)
+	t.Length = st.Length
+	t.PieceLength = st.PieceLength
+	t.FileCount = st.FileCount
+	t.Private = st.Private
+	t.CategoryConfidence = st.CategoryConf
 	if st.Name != nil {
 		t.Name = *st.Name
 	}
-	if st.CreatedAt != nil {
-		t.CreatedAt = *st.CreatedAt
+	if st.LastFailure != nil {
+		t.LastFailure = *st.LastFailure
+	}
+	if st.Source != nil {
+		t.Source = *st.Source
+	}
+	if st.Comment != nil {
+		t.Comment = *st.Comment
+	}
+	if st.CreatedBy != nil {
+		t.CreatedBy = *st.CreatedBy
 	}
-	if st.ResolvedAt != nil {
-		t.ResolvedAt = *st.ResolvedAt
+	if st.Category != nil {
+		t.Category = Category(*st.Category)
+	}
+	for _, f := range []struct {
+		dst *string
+		src *string
+	}{
+		{&r.Title, st.Title},
+		{&r.Resolution, st.Resolution},
+		{&r.Codec, st.Codec},
+		{&r.Source, st.ReleaseSource},
+		{&r.Group, st.ReleaseGroup},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	t.Release = r
+	t.Swarm.Peers = st.SwarmPeers
+	t.Swarm.SampledAt = time.Time(st.SwarmSampledAt)
+	t.Tracker.Seeders = st.TrackerCounts[0]
+	t.Tracker.Leechers = st.TrackerCounts[1]
+	t.Tracker.Completed = st.TrackerCounts[2]
+	t.Tracker.ScrapedAt = time.Time(st.TrackerScraped)
+	if st.SwarmSeeders != nil && st.SwarmLeechers != nil {
+		t.Swarm.Scraped = true
+		t.Swarm.Seeders = *st.SwarmSeeders
+		t.Swarm.Leechers = *st.SwarmLeechers
 	}
 
 	return t, nil
 }
 
-func NewSqliteDB(filePath string) (*SqliteDBClient, error) {
-	log.Printf("Using SQLite DB: %ssqlite.db", filePath)
-	ret := &SqliteDBClient{}
-	var err error
-	ret.db, err = sql.Open("sqlite3", filepath.Join(filePath, "sqlite.db"))
+func (me *sqlClient) Close() error {
+	return me.db.Close()
+}
+
+func (me *sqlClient) Stats() (*Stats, error) {
+	stats := &Stats{}
+	row := me.db.QueryRow(sqlTotalTorrents)
+	err := row.Scan(&stats.Torrents)
 	if err != nil {
 		return nil, err
 	}
-	_, err = ret.db.Exec(sqlCreateTorrentTable)
+	row = me.db.QueryRow(sqlTotalLookupOnly)
+	err = row.Scan(&stats.LookupOnly)
 	if err != nil {
-		ret.db.Close()
 		return nil, err
 	}
-	_, err = ret.db.Exec(sqlCreateFileInfoTable)
+	row = me.db.QueryRow(sqlTotalAnnounces)
+	err = row.Scan(&stats.Announces)
 	if err != nil {
-		ret.db.Close()
 		return nil, err
 	}
-	_, err = ret.db.Exec(sqlCreateSearchTable)
+	row = me.db.QueryRow(sqlTotalRawAnnounces)
+	err = row.Scan(&stats.RawAnnounces)
 	if err != nil {
-		ret.db.Close()
 		return nil, err
 	}
-	_, err = ret.db.Exec(sqlCreateAnnounceTable)
+	row = me.db.QueryRow(sqlTotalAnnounceIPs)
+	err = row.Scan(&stats.AnnounceIPs)
 	if err != nil {
-		ret.db.Close()
 		return nil, err
 	}
-	return ret, nil
-}
-
-func (me *SqliteDBClient) Close() error {
-	return me.db.Close()
-}
-
-func (me *SqliteDBClient) Stats() (*Stats, error) {
-	var torrents, announces, resolved int64
-	stats := &Stats{torrents, announces, resolved}
-	row := me.db.QueryRow(sqlTotalTorrents)
-	err := row.Scan(&stats.Torrents)
+	row = me.db.QueryRow(sqlTotalLookups)
+	err = row.Scan(&stats.Lookups)
 	if err != nil {
 		return nil, err
 	}
-	row = me.db.QueryRow(sqlTotalAnnounces)
-	err = row.Scan(&stats.Announces)
+	row = me.db.QueryRow(sqlTotalResolved)
+	err = row.Scan(&stats.Resolved)
 	if err != nil {
 		return nil, err
 	}
-	row = me.db.QueryRow(sqlTotalResolved)
-	err = row.Scan(&stats.Resolved)
+	row = me.db.QueryRow(sqlTotalSwarmSamples)
+	err = row.Scan(&stats.SwarmSamples)
+	if err != nil {
+		return nil, err
+	}
+	row = me.db.QueryRow(sqlTotalTrackerScrapes)
+	err = row.Scan(&stats.TrackerScrapes)
+	if err != nil {
+		return nil, err
+	}
+	row = me.db.QueryRow(sqlTotalQueued)
+	err = row.Scan(&stats.Queued)
+	if err != nil {
+		return nil, err
+	}
+	row = me.db.QueryRow(sqlTotalHinted)
+	err = row.Scan(&stats.HintedAttempts, &stats.HintedResolves)
 	if err != nil {
 		return nil, err
 	}
 	return stats, nil
 }
 
-func (me *SqliteDBClient) CreateTorrent(hash string) error {
+func (me *sqlClient) CreateTorrent(hash string) error {
 	_, err := me.db.Exec(sqlCreateTorrent, hash)
 	return err
 }
 
-func (me *SqliteDBClient) GetTorrent(hash string) (Torrent, error) {
+func (me *sqlClient) GetTorrent(hash string) (Torrent, error) {
 	row := me.db.QueryRow(sqlGetTorrent, hash)
 	t, err := scanTorrent(row.Scan)
 	if err != nil {
@@ -143,9 +611,13 @@ func (me *SqliteDBClient) GetTorrent(hash string) (Torrent, error) {
 	return t, nil
 }
 
-func (me *SqliteDBClient) GetFileInfo(hash string) ([]*FileInfo, error) {
+func (me *sqlClient) GetFileInfo(hash string) ([]*FileInfo, error) {
+	return getFileInfo(me.db, hash)
+}
+
+func getFileInfo(q sqlQueryer, hash string) ([]*FileInfo, error) {
 	ret := make([]*FileInfo, 0)
-	rows, err := me.db.Query(sqlGetFileInfo, hash)
+	rows, err := q.Query(sqlGetFileInfo, hash)
 	if err != nil {
 		return ret, err
 	}
@@ -161,9 +633,40 @@ func (me *SqliteDBClient) GetFileInfo(hash string) ([]*FileInfo, error) {
 	return ret, nil
 }
 
-func (me *SqliteDBClient) PopularTorrents(limit int) ([]Torrent, error) {
+// GetAnnouncers returns every distinct node that has announced hash, most
+// recent first.
+func (me *sqlClient) GetAnnouncers(hash string) ([]Announcer, error) {
+	ret := make([]Announcer, 0)
+	rows, err := me.db.Query(sqlGetAnnouncers, hash)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a := Announcer{}
+		var ip *string
+		var createdAt dbTime
+		err = rows.Scan(&a.InfoHash, &a.PeerID, &ip, &a.Port, &a.ImpliedPort, &createdAt)
+		if err != nil {
+			return ret, err
+		}
+		if ip != nil {
+			a.IP = *ip
+		}
+		a.CreatedAt = time.Time(createdAt)
+		ret = append(ret, a)
+	}
+	return ret, nil
+}
+
+// PopularTorrents returns the top limit torrents matching filter ranked by
+// mode, counting announces with counter. Torrents marked dead are left out
+// unless includeDead is set.
+func (me *sqlClient) PopularTorrents(limit int, mode RankMode, counter AnnounceCounter, filter SearchFilter, includeDead bool) ([]Torrent, error) {
 	ret := make([]Torrent, 0)
-	rows, err := me.db.Query(sqlPopularTorrents, limit)
+	cond, args := filter.where(counter)
+	args = append(args, limit)
+	rows, err := me.db.Query(me.db.sprintf(sqlPopularTorrents, deadFilter(includeDead), cond, mode.orderBy(counter)), args...)
 	if err != nil {
 		return ret, err
 	}
@@ -178,39 +681,77 @@ func (me *SqliteDBClient) PopularTorrents(limit int) ([]Torrent, error) {
 	return ret, nil
 }
 
-func (me *SqliteDBClient) TimelineTorrents(days int, limit int) ([]TimelineEntry, error) {
-	ret := make([]TimelineEntry, 0)
-	d := time.Now()
-	df := "-%d days"
-	for i := 0; i <= days; i++ {
-		ts := make([]Torrent, 0)
-		rows, err := me.db.Query(sqlPopularTorrentsDay, fmt.Sprintf(df, i), fmt.Sprintf(df, i+1), limit)
+// TrendingTorrents returns the top limit torrents matching filter by their
+// announces in the last window, ranked by view.
+func (me *sqlClient) TrendingTorrents(window time.Duration, limit int, view TrendView, filter SearchFilter) ([]TrendingTorrent, error) {
+	ret := make([]TrendingTorrent, 0)
+	w := newTrendWindow(time.Now(), window)
+	viewCond, score := view.where()
+	cond, fargs := filter.where(CountDistinct)
+	args := []interface{}{w.start, w.start, w.start, w.start, w.length, w.prev, w.prev}
+	args = append(append(args, fargs...), limit)
+	rows, err := me.db.Query(me.db.sprintf(sqlTrendingTorrents, cond, viewCond, score), args...)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t Torrent
+		var c trendCounts
+		t, err = scanTorrent(rows.Scan, &c.cur, &c.prev, &c.decayed)
 		if err != nil {
 			return ret, err
 		}
-		for rows.Next() {
-			t, err := scanTorrent(rows.Scan)
-			if err != nil {
-				return ret, err
-			}
-			ts = append(ts, t)
+		if tt, ok := c.trending(t, view); ok {
+			ret = append(ret, tt)
 		}
-		rows.Close()
-		ret = append(ret, TimelineEntry{d, ts})
-		d = d.Add(time.Hour * -24)
 	}
+	return ret, rows.Err()
+}
 
-	return ret, nil
+// AnnounceHistory returns the announces of hash in the last buckets buckets
+// of the given granularity up to now, oldest first. Announces are counted in
+// the middle of their hour, and rolled up announces in the middle of their
+// day.
+func (me *sqlClient) AnnounceHistory(hash string, buckets int, granularity Granularity) ([]HistoryBucket, error) {
+	ret, first := historyBuckets(time.Now(), buckets, granularity)
+	if len(ret) == 0 {
+		return ret, nil
+	}
+	size := granularity.seconds()
+	start, end := ret[0].Start.Unix(), ret[len(ret)-1].Start.Unix()+size
+	rows, err := me.db.Query(sqlAnnounceHistory, timelineOrigin, size,
+		hash, start-hourMidpoint, end-hourMidpoint, hash, start, end, hash, start-rollupMidday, end-rollupMidday)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bucket int64
+		var announces, announcers int
+		if err = rows.Scan(&bucket, &announces, &announcers); err != nil {
+			return ret, err
+		}
+		b := &ret[bucket-first]
+		b.Announces, b.Announcers = announces, announcers
+	}
+	return ret, rows.Err()
 }
 
-func (me *SqliteDBClient) SearchTorrents(term string, limit int) ([]Torrent, error) {
+// UnresolvedTorrents returns up to limit torrents that have failed to
+// resolve, dead torrents first and then by attempts. Only dead torrents are
+// returned if onlyDead is set.
+func (me *sqlClient) UnresolvedTorrents(limit int, onlyDead bool) ([]Torrent, error) {
 	ret := make([]Torrent, 0)
-	rows, err := me.db.Query(sqlSearchTorrents, strings.ToLower(term), limit)
+	filter := "1 = 1"
+	if onlyDead {
+		filter = "t.dead = 1"
+	}
+	rows, err := me.db.Query(me.db.sprintf(sqlUnresolvedTorrents, filter), limit)
 	if err != nil {
-		return nil, err
+		return ret, err
 	}
 	defer rows.Close()
-
 	for rows.Next() {
 		t, err := scanTorrent(rows.Scan)
 		if err != nil {
@@ -218,30 +759,561 @@ func (me *SqliteDBClient) SearchTorrents(term string, limit int) ([]Torrent, err
 		}
 		ret = append(ret, t)
 	}
+	return ret, nil
+}
+
+func deadFilter(includeDead bool) string {
+	if includeDead {
+		return "1 = 1"
+	}
+	return "t.dead = 0"
+}
 
+// TimelineTorrents returns the last buckets buckets of the given
+// granularity up to now, newest first, each with up to limit torrents
+// matching filter ranked by their activity in the bucket, counting
+// announces with counter.
+func (me *sqlClient) TimelineTorrents(buckets int, granularity Granularity, limit int, mode RankMode, counter AnnounceCounter, filter SearchFilter) ([]TimelineEntry, error) {
+	ret, last := timelineBuckets(time.Now(), buckets, granularity)
+	if len(ret) == 0 {
+		return ret, nil
+	}
+	size := granularity.seconds()
+	activity, args := timelineActivity(mode, counter, ret[len(ret)-1].Start.Unix(), ret[0].Start.Unix()+size)
+	args = append([]interface{}{timelineOrigin, size}, args...)
+	cond, fargs := filter.where(counter)
+	args = append(append(args, fargs...), limit)
+	q := me.db.sprintf(sqlTimelineTorrents, timelineScore(mode), activity, cond)
+	rows, err := me.db.Query(q, args...)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tt TimelineTorrent
+		var bucket int64
+		var pos int
+		tt.Torrent, err = scanTorrent(rows.Scan, &bucket, &tt.Count, &pos)
+		if err != nil {
+			return ret, err
+		}
+		e := &ret[last-bucket]
+		e.Torrents = append(e.Torrents, tt)
+	}
+	return ret, rows.Err()
+}
+
+// SearchTorrents returns up to limit torrents with a name or file path
+// matching term and filter, ranked by order and counting announces with
+// counter. Words in term like "year:2019", "res:1080p", "s:02", "e:05",
+// "codec:x265", "src:web-dl" or "group:NAME" filter on the parsed release
+// fields. Searches with only facets are ranked by popularity.
+func (me *sqlClient) SearchTorrents(term string, limit int, order SearchOrder, counter AnnounceCounter, filter SearchFilter) ([]SearchResult, error) {
+	ret := make([]SearchResult, 0)
+	words, err := parseQuery(term, &filter)
+	if err != nil {
+		return nil, err
+	}
+	match := ftsQuery(words)
+	cond, args := filter.where(counter)
+	var q string
+	if match == "" {
+		q = me.db.sprintf(sqlFacetTorrents, cond, RankSupply.orderBy(counter))
+		args = append(args, limit)
+	} else {
+		orderBy := "m.relevance"
+		n := limit
+		switch order {
+		case OrderPopular:
+			orderBy = RankSupply.orderBy(counter)
+		case OrderBlended:
+			n = limit * blendCandidates
+		}
+		q = me.db.sprintf(sqlSearchTorrents, cond, orderBy)
+		args = append([]interface{}{match}, args...)
+		args = append(args, n)
+	}
+	rows, err := me.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	highlight := termWords(parseQueryTerms(words))
+	for rows.Next() {
+		r := SearchResult{}
+		var name, path sql.NullString
+		var length, position sql.NullInt64
+		if match == "" {
+			r.Torrent, err = scanTorrent(rows.Scan)
+		} else {
+			r.Torrent, err = scanTorrent(rows.Scan, &r.Relevance, &name, &path, &length, &position)
+		}
+		if err != nil {
+			return ret, err
+		}
+		if name.Valid {
+			r.Snippet = snippet(name.String, highlight)
+		}
+		if position.Valid {
+			r.File = &FileInfo{path.String, length.Int64, int(position.Int64), r.InfoHash}
+		}
+		ret = append(ret, r)
+	}
+	if err = rows.Err(); err != nil {
+		return ret, err
+	}
+	if match != "" && order == OrderBlended {
+		ret = sortResults(ret, limit, OrderBlended, counter)
+	}
 	return ret, nil
 }
 
-func (me *SqliteDBClient) CreateFileInfo(hash string, path string, length int64, index int) error {
+// RollupAnnounces adds the announces made before before, and their hourly
+// counts, to the daily counts in announce_daily and deletes them, returning
+// how many announces were rolled up. The nodes rolled up are kept, so they
+// aren't counted as new announcers if they announce again. GetAnnouncers
+// only lists announces that haven't been rolled up.
+func (me *sqlClient) RollupAnnounces(before time.Time) (int64, error) {
+	tx, err := me.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = func() error {
+		for _, q := range []string{sqlRollupAnnounces, sqlMarkAnnouncesSeen, sqlRollupAnnounceHours, sqlDeleteAnnounceHoursBefore} {
+			if _, err := tx.Exec(q, before.Unix()); err != nil {
+				return err
+			}
+		}
+		res, err := tx.Exec(sqlDeleteAnnouncesBefore, before.Unix())
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	}()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// DeleteFileInfo removes the stored files of hash.
+func (me *sqlClient) DeleteFileInfo(hash string) error {
+	_, err := me.db.Exec(sqlDeleteFileInfo, hash)
+	return err
+}
+
+func (me *sqlClient) CreateFileInfo(hash string, path string, length int64, index int) error {
 	_, err := me.db.Exec(sqlCreateFileInfo, hash, path, length, index)
 	return err
 }
 
-func (me *SqliteDBClient) CreateAnnounce(hash string, peerId string) error {
-	_, err := me.db.Exec(sqlCreateAnnounce, hash, peerId)
+// CreateAnnounce records an announce of hash by the DHT node peerId from
+// the endpoint ip and port. An empty ip is stored as NULL.
+func (me *sqlClient) CreateAnnounce(hash string, peerId string, ip string, port int, impliedPort bool) error {
+	var nip *string
+	if ip != "" {
+		nip = &ip
+	}
+	res, err := me.db.Exec(sqlCreateAnnounce, hash, peerId, nip, port, impliedPort, hash, peerId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	_, err = me.db.Exec(sqlUpdateAnnounceCount, n, hash)
+	if err != nil {
+		return err
+	}
+	_, err = me.db.Exec(sqlCountAnnounce, hash)
+	return err
+}
+
+func (me *sqlClient) CreateLookup(hash string, nodeID string) error {
+	_, err := me.db.Exec(sqlCreateLookup, hash, nodeID)
+	if err != nil {
+		return err
+	}
+	_, err = me.db.Exec(sqlUpdateLookupCount, hash)
+	return err
+}
+
+func (me *sqlClient) SetTorrentMeta(hash string, m TorrentMeta) error {
+	m.Release = ParseRelease(m.Name)
+	r := m.Release
+	var created *int64
+	if !m.CreationDate.IsZero() {
+		u := m.CreationDate.Unix()
+		created = &u
+	}
+	_, err := me.db.Exec(sqlSetTorrentMeta, m.Name, m.Length, m.PieceLength, m.FileCount, m.Private,
+		nullString(m.Source), created, nullString(m.Comment), nullString(m.CreatedBy),
+		nullString(string(m.Category)), m.CategoryConfidence,
+		nullString(r.Title), r.Year, r.Season, r.Episode, nullString(r.Resolution), nullString(r.Codec),
+		nullString(r.Source), nullString(r.Group), hash)
+	return err
+}
+
+// SetTorrentInfo stores the bencoded info dictionary of a resolved torrent.
+func (me *sqlClient) SetTorrentInfo(hash string, info []byte) error {
+	_, err := me.db.Exec(sqlSetTorrentInfo, hash, info)
+	return err
+}
+
+// GetTorrentInfo returns the bencoded info dictionary stored for hash, or
+// sql.ErrNoRows if it hasn't been resolved since info was first stored.
+func (me *sqlClient) GetTorrentInfo(hash string) ([]byte, error) {
+	var info []byte
+	err := me.db.QueryRow(sqlGetTorrentInfo, hash).Scan(&info)
+	return info, err
+}
+
+// RecordResolveFailure counts a failed attempt to resolve hash. The hash
+// won't be dequeued for resolving again before retryAt and is never queued
+// again if dead is set.
+func (me *sqlClient) RecordResolveFailure(hash string, reason string, retryAt time.Time, dead bool) error {
+	_, err := me.db.Exec(sqlRecordResolveFailure, reason, retryAt.Unix(), dead, hash)
+	return err
+}
+
+// RecordResolveHint counts a resolve attempt of hash that was given
+// announcer endpoints as initial peers.
+func (me *sqlClient) RecordResolveHint(hash string, resolved bool) error {
+	n := 0
+	if resolved {
+		n = 1
+	}
+	_, err := me.db.Exec(sqlRecordResolveHint, n, hash)
+	return err
+}
+
+// CreateTorrentSearch indexes name, the torrent name or a file path of hash,
+// for search. file is the index of the file name is the path of, or -1. A
+// name already indexed for hash is skipped.
+func (me *sqlClient) CreateTorrentSearch(hash string, name string, file int) error {
+	var position interface{}
+	if file >= 0 {
+		position = file
+	}
+	_, err := me.db.Exec(sqlCreateTorrentSearch, hash, name, position)
+	return err
+}
+
+// DeleteTorrentSearch removes the names of hash from search.
+func (me *sqlClient) DeleteTorrentSearch(hash string) error {
+	_, err := me.db.Exec(sqlDeleteTorrentSearch, hash)
+	return err
+}
+
+// EnqueueHash adds hash to the resolve queue unless it is resolved or dead.
+// If hash is already queued it is marked as seen now, which raises its
+// priority.
+func (me *sqlClient) EnqueueHash(hash string) error {
+	_, err := me.db.Exec(sqlEnqueueHash, hash, hash)
 	if err != nil {
 		return err
 	}
-	_, err = me.db.Exec(sqlUpdateAnnounceCount, hash)
+	_, err = me.db.Exec(sqlClearLookupOnly, hash)
+	if err != nil {
+		return err
+	}
+	_, err = me.db.Exec(sqlTouchQueuedHash, hash)
 	return err
 }
 
-func (me *SqliteDBClient) SetTorrentMeta(hash string, name string, length int64) error {
-	_, err := me.db.Exec(sqlSetTorrentMeta, name, length, hash)
+// DequeueHashes returns up to limit of the highest priority queued hashes
+// and marks them started. Started hashes stay in the queue until
+// FinishHash is called so they survive a restart.
+func (me *sqlClient) DequeueHashes(limit int) ([]string, error) {
+	ret := make([]string, 0)
+	tx, err := me.db.Begin()
+	if err != nil {
+		return ret, err
+	}
+	rows, err := tx.Query(sqlNextQueuedHashes, limit)
+	if err != nil {
+		tx.Rollback()
+		return ret, err
+	}
+	for rows.Next() {
+		var h string
+		if err = rows.Scan(&h); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return ret, err
+		}
+		ret = append(ret, h)
+	}
+	rows.Close()
+	for _, h := range ret {
+		if _, err = tx.Exec(sqlStartQueuedHash, h); err != nil {
+			tx.Rollback()
+			return make([]string, 0), err
+		}
+	}
+	return ret, tx.Commit()
+}
+
+// FinishHash removes hash from the resolve queue.
+func (me *sqlClient) FinishHash(hash string) error {
+	_, err := me.db.Exec(sqlFinishQueuedHash, hash)
+	return err
+}
+
+// ResetResolveQueue returns hashes that were started but never finished,
+// for example because det exited mid resolve, to the queue.
+func (me *sqlClient) ResetResolveQueue() error {
+	_, err := me.db.Exec(sqlResetResolveQueue)
 	return err
 }
 
-func (me *SqliteDBClient) CreateTorrentSearch(hash string, name string) error {
-	_, err := me.db.Exec(sqlCreateTorrentSearch, hash, strings.ToLower(name))
+// TrimResolveQueue drops the lowest priority hashes that aren't started so
+// that at most max remain waiting. It returns the number dropped.
+func (me *sqlClient) TrimResolveQueue(max int) (int64, error) {
+	res, err := me.db.Exec(sqlTrimResolveQueue, max)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ResolveQueueDepth returns the number of hashes in the resolve queue.
+func (me *sqlClient) ResolveQueueDepth() (int64, error) {
+	var n int64
+	err := me.db.QueryRow(sqlTotalQueued).Scan(&n)
+	return n, err
+}
+
+// WriteBatch stores every announce, lookup and queued hash in b in a single
+// transaction.
+func (me *sqlClient) WriteBatch(b IngestBatch) error {
+	tx, err := me.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmts := make(map[string]*sqlStmt)
+	execResult := func(q string, args ...interface{}) (sql.Result, error) {
+		st, ok := stmts[q]
+		if !ok {
+			st, err = tx.Prepare(q)
+			if err != nil {
+				return nil, err
+			}
+			stmts[q] = st
+		}
+		return st.Exec(args...)
+	}
+	exec := func(q string, args ...interface{}) error {
+		_, err := execResult(q, args...)
+		return err
+	}
+	err = func() error {
+		for _, a := range b.Announces {
+			var ip *string
+			if a.IP != "" {
+				ip = &a.IP
+			}
+			if err := exec(sqlCreateTorrent, a.InfoHash); err != nil {
+				return err
+			}
+			res, err := execResult(sqlCreateAnnounce, a.InfoHash, a.PeerID, ip, a.Port, a.ImpliedPort, a.InfoHash, a.PeerID)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if err := exec(sqlUpdateAnnounceCount, n, a.InfoHash); err != nil {
+				return err
+			}
+			if err := exec(sqlCountAnnounce, a.InfoHash); err != nil {
+				return err
+			}
+		}
+		for _, l := range b.Lookups {
+			if err := exec(sqlCreateLookupTorrent, l.InfoHash); err != nil {
+				return err
+			}
+			if err := exec(sqlCreateLookup, l.InfoHash, l.NodeID); err != nil {
+				return err
+			}
+			if err := exec(sqlUpdateLookupCount, l.InfoHash); err != nil {
+				return err
+			}
+		}
+		for _, h := range b.Queue {
+			if err := exec(sqlCreateTorrent, h); err != nil {
+				return err
+			}
+			if err := exec(sqlClearLookupOnly, h); err != nil {
+				return err
+			}
+			if err := exec(sqlEnqueueHash, h, h); err != nil {
+				return err
+			}
+			if err := exec(sqlTouchQueuedHash, h); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	for _, st := range stmts {
+		st.Close()
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// nullString returns nil for an empty s so it is stored as NULL.
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// SwarmSampleCandidates returns up to limit of the most popular resolved
+// torrents that haven't had a swarm sample since before.
+func (me *sqlClient) SwarmSampleCandidates(before time.Time, limit int) ([]Torrent, error) {
+	ret := make([]Torrent, 0)
+	rows, err := me.db.Query(sqlSwarmSampleCandidates, before.Unix(), before.Unix(), limit)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanTorrent(rows.Scan)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
+
+// RecordSwarmSample stores s and makes it the latest swarm estimate of hash.
+func (me *sqlClient) RecordSwarmSample(hash string, s SwarmSample) error {
+	var seeders, leechers *int
+	if s.Scraped {
+		seeders, leechers = &s.Seeders, &s.Leechers
+	}
+	tx, err := me.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sqlCreateSwarmSample, hash, s.SampledAt.Unix(), s.Peers, seeders, leechers)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(sqlSetSwarm, s.SampledAt.Unix(), s.Peers, seeders, leechers, s.Size(), hash)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordSwarmFailure marks a failed swarm sample of hash at, keeping its
+// latest estimate, so it isn't sampled again before SwarmSampleInterval.
+func (me *sqlClient) RecordSwarmFailure(hash string, at time.Time) error {
+	_, err := me.db.Exec(sqlSetSwarmFailed, at.Unix(), hash)
 	return err
 }
+
+// AddTrackers records announce URLs listed in the metadata of hash.
+func (me *sqlClient) AddTrackers(hash string, urls []string) error {
+	for _, u := range urls {
+		if _, err := me.db.Exec(sqlAddTracker, hash, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTrackers returns the announce URLs recorded for hash.
+func (me *sqlClient) GetTrackers(hash string) ([]string, error) {
+	ret := make([]string, 0)
+	rows, err := me.db.Query(sqlGetTrackers, hash)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u string
+		if err = rows.Scan(&u); err != nil {
+			return ret, err
+		}
+		ret = append(ret, u)
+	}
+	return ret, rows.Err()
+}
+
+// TrackerScrapeCandidates returns up to limit of the most popular resolved
+// torrents that haven't been scraped since before. If onlyWithTrackers is
+// set, only torrents with trackers of their own are returned.
+func (me *sqlClient) TrackerScrapeCandidates(before time.Time, onlyWithTrackers bool, limit int) ([]string, error) {
+	filter := "1 = 1"
+	if onlyWithTrackers {
+		filter = "EXISTS (SELECT 1 FROM torrent_tracker AS tt WHERE tt.infoHash = t.infoHash)"
+	}
+	ret := make([]string, 0)
+	rows, err := me.db.Query(me.db.sprintf(sqlTrackerScrapeCandidates, filter), before.Unix(), limit)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h string
+		if err = rows.Scan(&h); err != nil {
+			return ret, err
+		}
+		ret = append(ret, h)
+	}
+	return ret, rows.Err()
+}
+
+// RecordTrackerScrapes stores the successful scrapes of hash made at. The
+// scrape with the most seeders becomes the torrent's latest tracker counts.
+// The torrent is marked scraped even if scrapes is empty so it isn't retried
+// before TrackerScrapeInterval.
+func (me *sqlClient) RecordTrackerScrapes(hash string, at time.Time, scrapes []TrackerScrape) error {
+	tx, err := me.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		if _, err := tx.Exec(sqlSetTrackerScraped, at.Unix(), hash); err != nil {
+			return err
+		}
+		if len(scrapes) == 0 {
+			return nil
+		}
+		best := scrapes[0]
+		for _, ts := range scrapes {
+			_, err := tx.Exec(sqlCreateTrackerScrape, hash, ts.Tracker, ts.ScrapedAt.Unix(), ts.Seeders, ts.Leechers, ts.Completed)
+			if err != nil {
+				return err
+			}
+			if ts.Seeders > best.Seeders {
+				best = ts
+			}
+		}
+		_, err := tx.Exec(sqlSetTrackerCounts, best.Seeders, best.Leechers, best.Completed, hash)
+		return err
+	}()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
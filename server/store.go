@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Store backends, selected with Config.Store.
+const (
+	// StoreSQLite keeps the index in a SQLite file in SqlitePath.
+	StoreSQLite = "sqlite"
+	// StorePostgres keeps the index in the Postgres database at PostgresURL.
+	StorePostgres = "postgres"
+	// StoreMemory keeps the index in memory. Nothing survives a restart, so
+	// it is mostly useful for tests.
+	StoreMemory = "memory"
+)
+
+// Store is the torrent index. It covers ingesting announces and lookups,
+// the resolve queue, resolved metadata, swarm and tracker samples, and the
+// queries and stats behind the det commands. Lookups of a single torrent
+// return sql.ErrNoRows if it isn't stored.
+type Store interface {
+	Close() error
+	Stats() (*Stats, error)
+
+	CreateTorrent(hash string) error
+	CreateAnnounce(hash string, peerId string, ip string, port int, impliedPort bool) error
+	CreateLookup(hash string, nodeID string) error
+	WriteBatch(b IngestBatch) error
+
+	EnqueueHash(hash string) error
+	DequeueHashes(limit int) ([]string, error)
+	FinishHash(hash string) error
+	ResetResolveQueue() error
+	TrimResolveQueue(max int) (int64, error)
+	ResolveQueueDepth() (int64, error)
+	RecordResolveFailure(hash string, reason string, retryAt time.Time, dead bool) error
+	RecordResolveHint(hash string, resolved bool) error
+
+	SetTorrentMeta(hash string, m TorrentMeta) error
+	SetTorrentInfo(hash string, info []byte) error
+	CreateTorrentSearch(hash string, name string, file int) error
+	DeleteTorrentSearch(hash string) error
+	CreateFileInfo(hash string, path string, length int64, index int) error
+	DeleteFileInfo(hash string) error
+	AddTrackers(hash string, urls []string) error
+
+	GetTorrent(hash string) (Torrent, error)
+	GetTorrentInfo(hash string) ([]byte, error)
+	GetFileInfo(hash string) ([]*FileInfo, error)
+	GetAnnouncers(hash string) ([]Announcer, error)
+	GetTrackers(hash string) ([]string, error)
+
+	PopularTorrents(limit int, mode RankMode, counter AnnounceCounter, filter SearchFilter, includeDead bool) ([]Torrent, error)
+	TimelineTorrents(buckets int, granularity Granularity, limit int, mode RankMode, counter AnnounceCounter, filter SearchFilter) ([]TimelineEntry, error)
+	SearchTorrents(term string, limit int, order SearchOrder, counter AnnounceCounter, filter SearchFilter) ([]SearchResult, error)
+	AnnounceHistory(hash string, buckets int, granularity Granularity) ([]HistoryBucket, error)
+	TrendingTorrents(window time.Duration, limit int, view TrendView, filter SearchFilter) ([]TrendingTorrent, error)
+	UnresolvedTorrents(limit int, onlyDead bool) ([]Torrent, error)
+
+	SwarmSampleCandidates(before time.Time, limit int) ([]Torrent, error)
+	RecordSwarmSample(hash string, s SwarmSample) error
+	RecordSwarmFailure(hash string, at time.Time) error
+	TrackerScrapeCandidates(before time.Time, onlyWithTrackers bool, limit int) ([]string, error)
+	RecordTrackerScrapes(hash string, at time.Time, scrapes []TrackerScrape) error
+
+	RollupAnnounces(before time.Time) (int64, error)
+}
+
+// Migrator is implemented by stores with a versioned schema.
+type Migrator interface {
+	Close() error
+	SchemaVersion() (int, error)
+	LatestSchemaVersion() int
+	PendingMigrations() ([]Migration, error)
+	Migrate() ([]Migration, error)
+}
+
+// NewStore opens the store selected in cfg and applies any pending
+// migrations.
+func NewStore(cfg *Config) (Store, error) {
+	switch cfg.Store {
+	case StoreSQLite, "":
+		return NewSqliteDB(cfg.SqlitePath)
+	case StorePostgres:
+		return NewPostgresDB(cfg.PostgresURL)
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("Unknown store: %q", cfg.Store)
+	}
+}
+
+// OpenMigrator opens the store selected in cfg without migrating it.
+func OpenMigrator(cfg *Config) (Migrator, error) {
+	switch cfg.Store {
+	case StoreSQLite, "":
+		return OpenSqliteDB(cfg.SqlitePath)
+	case StorePostgres:
+		return OpenPostgresDB(cfg.PostgresURL)
+	case StoreMemory:
+		return nil, fmt.Errorf("The memory store has no schema to migrate")
+	default:
+		return nil, fmt.Errorf("Unknown store: %q", cfg.Store)
+	}
+}
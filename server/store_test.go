@@ -0,0 +1,393 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeTestPostgresURL names the environment variable holding a Postgres
+// connection string to run the Store tests against. Each test runs in its
+// own schema, which is dropped afterwards.
+const storeTestPostgresURL = "DET_TEST_POSTGRES_URL"
+
+// testStores returns a constructor of an empty store for each backend the
+// Store tests run against.
+func testStores() map[string]func(t *testing.T) Store {
+	return map[string]func(t *testing.T) Store{
+		StoreMemory:   func(t *testing.T) Store { return NewMemoryStore() },
+		StoreSQLite:   newTestSqliteStore,
+		StorePostgres: newTestPostgresStore,
+	}
+}
+
+func newTestSqliteStore(t *testing.T) Store {
+	s, err := NewSqliteDB(t.TempDir() + "/")
+	if err != nil {
+		// SQLite needs cgo, and search needs the sqlite_fts5 build tag.
+		if strings.Contains(err.Error(), "CGO_ENABLED=0") || strings.Contains(err.Error(), "FTS5") {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestPostgresStore(t *testing.T) Store {
+	url := os.Getenv(storeTestPostgresURL)
+	if url == "" {
+		t.Skipf("Set %s to test Postgres", storeTestPostgresURL)
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("det_test_%d", rand.Int63())
+	if _, err = db.Exec("CREATE SCHEMA " + schema); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		db.Close()
+	})
+	if strings.Contains(url, "://") {
+		if strings.Contains(url, "?") {
+			url += "&search_path=" + schema
+		} else {
+			url += "?search_path=" + schema
+		}
+	} else {
+		url += " search_path=" + schema
+	}
+	s, err := NewPostgresDB(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// runStoreTest runs test against an empty store of every backend.
+func runStoreTest(t *testing.T, test func(t *testing.T, s Store)) {
+	for name, open := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			test(t, s)
+		})
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testHash(n int) string {
+	return fmt.Sprintf("%040x", n)
+}
+
+// ingestTestAnnounces stores announces of testHash(1) by three nodes, one of
+// them three times, and of testHash(2) by one node.
+func ingestTestAnnounces(t *testing.T, s Store) {
+	must(t, s.WriteBatch(IngestBatch{
+		Announces: []Announce{
+			{testHash(1), "node1", "10.0.0.1", 6881, false},
+			{testHash(1), "node1", "10.0.0.1", 6881, false},
+			{testHash(1), "node2", "10.0.0.2", 6882, true},
+			{testHash(2), "node1", "10.0.0.1", 6881, false},
+		},
+	}))
+	must(t, s.CreateAnnounce(testHash(1), "node1", "10.0.0.1", 6881, false))
+	must(t, s.CreateAnnounce(testHash(1), "node3", "", 6883, false))
+}
+
+func TestStoreIngest(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		ingestTestAnnounces(t, s)
+		must(t, s.WriteBatch(IngestBatch{
+			Lookups: []Lookup{{testHash(1), "node4"}, {testHash(3), "node4"}},
+		}))
+		tr, err := s.GetTorrent(testHash(1))
+		must(t, err)
+		if tr.AnnounceCount != 3 || tr.RawAnnounceCount != 5 || tr.LookupCount != 1 {
+			t.Errorf("got %d announcers, %d announces, %d lookups, want 3, 5, 1",
+				tr.AnnounceCount, tr.RawAnnounceCount, tr.LookupCount)
+		}
+		as, err := s.GetAnnouncers(testHash(1))
+		must(t, err)
+		if len(as) != 3 {
+			t.Errorf("got %d announcers, want 3", len(as))
+		}
+		if _, err = s.GetTorrent(testHash(9)); err != sql.ErrNoRows {
+			t.Errorf("got %v for an unknown torrent, want sql.ErrNoRows", err)
+		}
+		st, err := s.Stats()
+		must(t, err)
+		if st.Torrents != 2 || st.LookupOnly != 1 || st.Announces != 4 || st.Lookups != 2 {
+			t.Errorf("got stats %+v", *st)
+		}
+	})
+}
+
+func TestStoreQueue(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		ingestTestAnnounces(t, s)
+		must(t, s.WriteBatch(IngestBatch{Queue: []string{testHash(2), testHash(1), testHash(3)}}))
+		must(t, s.SetTorrentMeta(testHash(3), TorrentMeta{Name: "Resolved"}))
+		must(t, s.EnqueueHash(testHash(3)))
+		n, err := s.ResolveQueueDepth()
+		must(t, err)
+		if n != 3 {
+			t.Errorf("got depth %d, want 3", n)
+		}
+		// testHash(3) was queued before it was resolved.
+		must(t, s.FinishHash(testHash(3)))
+		hs, err := s.DequeueHashes(10)
+		must(t, err)
+		if want := []string{testHash(1), testHash(2)}; !reflect.DeepEqual(hs, want) {
+			t.Errorf("dequeued %v, want %v", hs, want)
+		}
+		if hs, _ = s.DequeueHashes(10); len(hs) != 0 {
+			t.Errorf("dequeued %v again", hs)
+		}
+		must(t, s.ResetResolveQueue())
+		must(t, s.RecordResolveFailure(testHash(1), "timeout", time.Now().Add(time.Hour), false))
+		hs, err = s.DequeueHashes(10)
+		must(t, err)
+		if want := []string{testHash(2)}; !reflect.DeepEqual(hs, want) {
+			t.Errorf("dequeued %v while testHash(1) backs off, want %v", hs, want)
+		}
+		must(t, s.ResetResolveQueue())
+		trimmed, err := s.TrimResolveQueue(1)
+		must(t, err)
+		if trimmed != 1 {
+			t.Errorf("trimmed %d, want 1", trimmed)
+		}
+	})
+}
+
+// resolveTestTorrent stores hash as resolved with the given files, like
+// Server.storeInfo.
+func resolveTestTorrent(t *testing.T, s Store, hash string, name string, files []FileInfo) {
+	var length int64
+	for _, f := range files {
+		length += f.Length
+	}
+	must(t, s.CreateTorrent(hash))
+	nameFile := -1
+	if len(files) == 1 {
+		nameFile = 0
+	}
+	must(t, s.CreateTorrentSearch(hash, name, nameFile))
+	for i, f := range files {
+		must(t, s.CreateFileInfo(hash, f.Path, f.Length, i))
+		if len(files) > 1 {
+			must(t, s.CreateTorrentSearch(hash, f.Path, i))
+		}
+	}
+	c, conf := Classify(files)
+	must(t, s.SetTorrentMeta(hash, TorrentMeta{
+		Name: name, Length: length, FileCount: len(files), Category: c, CategoryConfidence: conf,
+	}))
+}
+
+func TestStoreSearch(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		resolveTestTorrent(t, s, testHash(1), "Ubuntu 18.04 Desktop", []FileInfo{
+			{Path: "ubuntu-18.04-desktop-amd64.iso", Length: 2 << 30},
+		})
+		resolveTestTorrent(t, s, testHash(2), "Some.Show.S01E02.1080p.WEB-DL", []FileInfo{
+			{Path: "Some.Show.S01E02.1080p.WEB-DL/episode.mkv", Length: 1 << 30},
+			{Path: "Some.Show.S01E02.1080p.WEB-DL/notes.nfo", Length: 1 << 10},
+		})
+		must(t, s.CreateTorrent(testHash(3)))
+		must(t, s.CreateTorrentSearch(testHash(3), "Unresolved Ubuntu", -1))
+		ingestTestAnnounces(t, s)
+		tests := []struct {
+			query  string
+			filter SearchFilter
+			want   []string
+		}{
+			{"ubuntu", SearchFilter{}, []string{testHash(1), testHash(3)}},
+			{"notes", SearchFilter{}, []string{testHash(2)}},
+			{"show ext:mkv", SearchFilter{}, []string{testHash(2)}},
+			{"ubuntu size:>1GB", SearchFilter{}, []string{testHash(1)}},
+			{"res:1080p", SearchFilter{}, []string{testHash(2)}},
+			{"ubuntu", SearchFilter{Category: CategoryVideo}, []string{}},
+			{"show -web", SearchFilter{}, []string{}},
+			{"debian", SearchFilter{}, []string{}},
+		}
+		for _, tt := range tests {
+			rs, err := s.SearchTorrents(tt.query, 10, OrderRelevance, CountDistinct, tt.filter)
+			must(t, err)
+			got := make([]string, len(rs))
+			for i, r := range rs {
+				got[i] = r.InfoHash
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%q found %v, want %v", tt.query, got, tt.want)
+			}
+		}
+		rs, err := s.SearchTorrents("notes", 10, OrderRelevance, CountDistinct, SearchFilter{})
+		must(t, err)
+		if len(rs) != 1 || rs[0].File == nil || rs[0].File.Path != "Some.Show.S01E02.1080p.WEB-DL/notes.nfo" {
+			t.Fatalf("got %+v, want the matching file", rs)
+		}
+		if want := "…S01E02.1080p.WEB-DL/" + HighlightStart + "notes" + HighlightEnd + ".nfo"; rs[0].Snippet != want {
+			t.Errorf("got snippet %q, want %q", rs[0].Snippet, want)
+		}
+		if _, err = s.SearchTorrents(`"unterminated`, 10, OrderRelevance, CountDistinct, SearchFilter{}); err == nil {
+			t.Error("searched an unterminated phrase")
+		}
+	})
+}
+
+func TestStoreTimeline(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		ingestTestAnnounces(t, s)
+		must(t, s.WriteBatch(IngestBatch{Lookups: []Lookup{{testHash(2), "a"}, {testHash(2), "b"}}}))
+		tests := []struct {
+			mode    RankMode
+			counter AnnounceCounter
+			want    []TimelineTorrent
+		}{
+			{RankSupply, CountDistinct, []TimelineTorrent{{Torrent{InfoHash: testHash(1)}, 3}, {Torrent{InfoHash: testHash(2)}, 1}}},
+			{RankSupply, CountRaw, []TimelineTorrent{{Torrent{InfoHash: testHash(1)}, 5}, {Torrent{InfoHash: testHash(2)}, 1}}},
+			{RankDemand, CountDistinct, []TimelineTorrent{{Torrent{InfoHash: testHash(2)}, 2}}},
+			{RankCombined, CountDistinct, []TimelineTorrent{{Torrent{InfoHash: testHash(1)}, 3}, {Torrent{InfoHash: testHash(2)}, 3}}},
+			{RankCombined, CountRaw, []TimelineTorrent{{Torrent{InfoHash: testHash(1)}, 5}, {Torrent{InfoHash: testHash(2)}, 3}}},
+		}
+		for _, tt := range tests {
+			tl, err := s.TimelineTorrents(2, GranularityDay, 10, tt.mode, tt.counter, SearchFilter{})
+			must(t, err)
+			if len(tl) != 2 || len(tl[1].Torrents) != 0 {
+				t.Fatalf("%s %s: got %+v, want this day and an empty day before it", tt.mode, tt.counter, tl)
+			}
+			got := tl[0].Torrents
+			if len(got) != len(tt.want) {
+				t.Errorf("%s %s: got %d torrents, want %d", tt.mode, tt.counter, len(got), len(tt.want))
+				continue
+			}
+			for i, w := range tt.want {
+				if got[i].InfoHash != w.InfoHash || got[i].Count != w.Count {
+					t.Errorf("%s %s: got %s with %d, want %s with %d", tt.mode, tt.counter, got[i].InfoHash, got[i].Count, w.InfoHash, w.Count)
+				}
+			}
+		}
+	})
+}
+
+func TestStoreTrending(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		ingestTestAnnounces(t, s)
+		ts, err := s.TrendingTorrents(24*time.Hour, 10, TrendRising, SearchFilter{})
+		must(t, err)
+		got := make([]string, len(ts))
+		for i, tt := range ts {
+			got[i] = fmt.Sprintf("%s %d %d", tt.InfoHash, tt.Current, tt.Previous)
+		}
+		want := []string{testHash(1) + " 5 0", testHash(2) + " 1 0"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		ts, err = s.TrendingTorrents(24*time.Hour, 10, TrendFalling, SearchFilter{})
+		must(t, err)
+		if len(ts) != 0 {
+			t.Errorf("got %d falling torrents, want none", len(ts))
+		}
+	})
+}
+
+func TestStoreHistory(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		ingestTestAnnounces(t, s)
+		for _, g := range []Granularity{GranularityHour, GranularityDay, GranularityWeek} {
+			hs, err := s.AnnounceHistory(testHash(1), 3, g)
+			must(t, err)
+			if len(hs) != 3 {
+				t.Fatalf("%s: got %d buckets, want 3", g, len(hs))
+			}
+			if hs[0].Announces != 0 || hs[1].Announces != 0 || hs[2].Announces != 5 || hs[2].Announcers != 3 {
+				t.Errorf("%s: got %+v, want 5 announces by 3 announcers in the last bucket", g, hs)
+			}
+		}
+	})
+}
+
+func TestStoreRollup(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		ingestTestAnnounces(t, s)
+		before, err := s.Stats()
+		must(t, err)
+		n, err := s.RollupAnnounces(AnnounceRollupCutoff(time.Now(), -1))
+		must(t, err)
+		if n != 4 {
+			t.Errorf("rolled up %d announces, want 4", n)
+		}
+		as, err := s.GetAnnouncers(testHash(1))
+		must(t, err)
+		if len(as) != 0 {
+			t.Errorf("got %d announcers after the rollup, want 0", len(as))
+		}
+		// A rolled up node announcing again isn't a new announcer.
+		must(t, s.CreateAnnounce(testHash(1), "node2", "10.0.0.2", 6882, true))
+		tr, err := s.GetTorrent(testHash(1))
+		must(t, err)
+		if tr.AnnounceCount != 3 || tr.RawAnnounceCount != 6 {
+			t.Errorf("got %d announcers and %d announces, want 3 and 6", tr.AnnounceCount, tr.RawAnnounceCount)
+		}
+		after, err := s.Stats()
+		must(t, err)
+		if after.Announces != before.Announces {
+			t.Errorf("got %d announces after the rollup, want %d", after.Announces, before.Announces)
+		}
+		hs, err := s.AnnounceHistory(testHash(1), 1, GranularityDay)
+		must(t, err)
+		if hs[0].Announces != 6 || hs[0].Announcers != 3 {
+			t.Errorf("got %+v, want 6 announces by 3 announcers", hs[0])
+		}
+	})
+}
+
+func TestStoreSwarmSample(t *testing.T) {
+	runStoreTest(t, func(t *testing.T, s Store) {
+		ingestTestAnnounces(t, s)
+		resolveTestTorrent(t, s, testHash(1), "One", []FileInfo{{Path: "One.mkv", Length: 1}})
+		resolveTestTorrent(t, s, testHash(2), "Two", []FileInfo{{Path: "Two.mkv", Length: 1}})
+		now := time.Now()
+		must(t, s.RecordSwarmSample(testHash(1), SwarmSample{SampledAt: now.Add(-2 * time.Hour), Peers: 4}))
+		must(t, s.RecordSwarmFailure(testHash(1), now))
+		candidates := func(before time.Time) []string {
+			ts, err := s.SwarmSampleCandidates(before, 10)
+			must(t, err)
+			ret := make([]string, len(ts))
+			for i, tr := range ts {
+				ret[i] = tr.InfoHash
+			}
+			return ret
+		}
+		// A failed sample waits for the next sample to be due, like a
+		// successful one.
+		if got, want := candidates(now.Add(-time.Hour)), []string{testHash(2)}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got candidates %v, want %v", got, want)
+		}
+		if got, want := candidates(now.Add(time.Hour)), []string{testHash(1), testHash(2)}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got candidates %v, want %v", got, want)
+		}
+		tr, err := s.GetTorrent(testHash(1))
+		must(t, err)
+		if tr.Swarm.Peers != 4 {
+			t.Errorf("got %d peers after a failed sample, want the last estimate of 4", tr.Swarm.Peers)
+		}
+	})
+}
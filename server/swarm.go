@@ -0,0 +1,288 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"math"
+	"math/big"
+	"math/bits"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/dht/v2/krpc"
+)
+
+const (
+	// swarmQueryTimeout is how long to wait for a get_peers reply.
+	swarmQueryTimeout = time.Second * 5
+
+	// swarmAlpha is the number of nodes queried at once during a lookup.
+	swarmAlpha = 8
+
+	// swarmMaxRounds limits how many rounds of closer nodes a lookup
+	// follows.
+	swarmMaxRounds = 4
+
+	// swarmCandidates is how many of the most popular torrents due for a
+	// sample are considered at each tick.
+	swarmCandidates = 100
+
+	// bep33FilterBits is the size of a BEP 33 scrape bloom filter.
+	bep33FilterBits = 2048
+)
+
+// getPeersReply is the response dictionary for get_peers, including the BEP
+// 33 seed and peer bloom filters returned for scrape requests.
+type getPeersReply struct {
+	ID     krpc.ID                  `bencode:"id"`
+	Nodes  krpc.CompactIPv4NodeInfo `bencode:"nodes,omitempty"`
+	Values []krpc.NodeAddr          `bencode:"values,omitempty"`
+	BFsd   string                   `bencode:"BFsd,omitempty"`
+	BFpe   string                   `bencode:"BFpe,omitempty"`
+}
+
+// swarmSampler periodically looks up resolved torrents on the DHT with
+// get_peers to estimate the size of their swarms. Torrents are picked at
+// random from the most popular ones that haven't been sampled, or failed a
+// sample, within SwarmSampleInterval, weighted by popularity, at
+// SwarmSampleRate lookups per minute.
+type swarmSampler struct {
+	s        *Server
+	c        *krpcClient
+	mu       sync.Mutex
+	inflight map[string]bool
+	samples  int
+	stop     chan struct{}
+}
+
+func newSwarmSampler(s *Server) (*swarmSampler, error) {
+	c, err := newKRPCClient(s.config.ListenHost)
+	if err != nil {
+		return nil, err
+	}
+	return &swarmSampler{
+		s:        s,
+		c:        c,
+		inflight: make(map[string]bool),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// Run samples until Close is called.
+func (ss *swarmSampler) Run() {
+	rate := ss.s.config.SwarmSampleRate
+	if rate <= 0 {
+		rate = 1
+	}
+	tick := time.NewTicker(time.Minute / time.Duration(rate))
+	defer tick.Stop()
+	for {
+		select {
+		case <-ss.stop:
+			return
+		case <-tick.C:
+			t, ok := ss.next()
+			if ok {
+				go ss.sample(t)
+			}
+		}
+	}
+}
+
+// Close stops sampling.
+func (ss *swarmSampler) Close() {
+	close(ss.stop)
+	ss.c.Close()
+}
+
+// next picks a torrent to sample and marks it in flight.
+func (ss *swarmSampler) next() (Torrent, bool) {
+	before := time.Now().Add(-ss.s.config.SwarmSampleInterval)
+	ts, err := ss.s.db.SwarmSampleCandidates(before, swarmCandidates)
+	if err != nil {
+		log.Printf("SwarmSampleCandidates Error:\t%s", err)
+		return Torrent{}, false
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var total int
+	due := make([]Torrent, 0, len(ts))
+	for _, t := range ts {
+		if !ss.inflight[t.InfoHash] {
+			due = append(due, t)
+			total += t.Rank(RankCombined, CountDistinct) + 1
+		}
+	}
+	if len(due) == 0 {
+		return Torrent{}, false
+	}
+	n := rand.Intn(total)
+	for _, t := range due {
+		n -= t.Rank(RankCombined, CountDistinct) + 1
+		if n < 0 {
+			ss.inflight[t.InfoHash] = true
+			return t, true
+		}
+	}
+	return Torrent{}, false
+}
+
+func (ss *swarmSampler) sample(t Torrent) {
+	defer func() {
+		ss.mu.Lock()
+		delete(ss.inflight, t.InfoHash)
+		ss.samples++
+		ss.mu.Unlock()
+	}()
+	sample, err := ss.getPeers(t.InfoHash)
+	if err != nil {
+		log.Printf("Swarm sample error:\t%s\t%s", t.InfoHash, err)
+		if err = ss.s.db.RecordSwarmFailure(t.InfoHash, time.Now()); err != nil {
+			log.Printf("RecordSwarmFailure Error:\t%s", err)
+		}
+		return
+	}
+	if err = ss.s.db.RecordSwarmSample(t.InfoHash, sample); err != nil {
+		log.Printf("RecordSwarmSample Error:\t%s", err)
+	}
+}
+
+// lookupNode is a node found during a get_peers lookup.
+type lookupNode struct {
+	addr     *net.UDPAddr
+	distance *big.Int
+	queried  bool
+}
+
+// getPeers runs an iterative get_peers lookup for hx, starting from the nodes
+// in our routing tables, and counts the distinct peers returned. Scrape
+// bloom filters from nodes supporting BEP 33 are merged to estimate seeders
+// and leechers. It fails if no node replied, rather than report an empty
+// swarm.
+func (ss *swarmSampler) getPeers(hx string) (SwarmSample, error) {
+	var target krpc.ID
+	b, err := hex.DecodeString(hx)
+	if err != nil {
+		return SwarmSample{}, err
+	}
+	copy(target[:], b)
+
+	nodes := make(map[string]*lookupNode)
+	addNodes := func(nis []krpc.NodeInfo) {
+		for _, ni := range nis {
+			if ni.Addr.Port == 0 || ni.Addr.IP.IsUnspecified() {
+				continue
+			}
+			k := ni.Addr.String()
+			if _, ok := nodes[k]; ok {
+				continue
+			}
+			d := new(big.Int).SetBytes(xorID(ni.ID, target))
+			nodes[k] = &lookupNode{addr: ni.Addr.UDP(), distance: d}
+		}
+	}
+	for _, d := range ss.s.dhtServers() {
+		addNodes(d.Nodes())
+	}
+
+	var mu sync.Mutex
+	peers := make(map[string]bool)
+	var seeds, leechers [bep33FilterBits / 8]byte
+	scraped := false
+	replies := 0
+	for round := 0; round < swarmMaxRounds; round++ {
+		closest := make([]*lookupNode, 0, len(nodes))
+		for _, n := range nodes {
+			if !n.queried {
+				closest = append(closest, n)
+			}
+		}
+		if len(closest) == 0 {
+			break
+		}
+		sort.Slice(closest, func(i, j int) bool {
+			return closest[i].distance.Cmp(closest[j].distance) < 0
+		})
+		if len(closest) > swarmAlpha {
+			closest = closest[:swarmAlpha]
+		}
+		var wg sync.WaitGroup
+		found := make([]krpc.NodeInfo, 0)
+		for _, n := range closest {
+			n.queried = true
+			wg.Add(1)
+			go func(n *lookupNode) {
+				defer wg.Done()
+				var r getPeersReply
+				a := &krpc.MsgArgs{InfoHash: target, Scrape: 1}
+				if err := ss.c.Query(n.addr, "get_peers", a, &r, swarmQueryTimeout); err != nil {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				replies++
+				for _, p := range r.Values {
+					peers[p.String()] = true
+				}
+				if len(r.BFsd) == len(seeds) && len(r.BFpe) == len(leechers) {
+					scraped = true
+					for i := range seeds {
+						seeds[i] |= r.BFsd[i]
+						leechers[i] |= r.BFpe[i]
+					}
+				}
+				found = append(found, r.Nodes...)
+			}(n)
+		}
+		wg.Wait()
+		addNodes(found)
+	}
+
+	if replies == 0 {
+		return SwarmSample{}, errors.New("No node replied to get_peers")
+	}
+	sample := SwarmSample{
+		SampledAt: time.Now(),
+		Peers:     len(peers),
+		Scraped:   scraped,
+	}
+	if scraped {
+		sample.Seeders = bloomEstimate(seeds[:])
+		sample.Leechers = bloomEstimate(leechers[:])
+	}
+	return sample, nil
+}
+
+func xorID(a, b krpc.ID) []byte {
+	ret := make([]byte, len(a))
+	for i := range a {
+		ret[i] = a[i] ^ b[i]
+	}
+	return ret
+}
+
+// bloomEstimate returns the number of items in a BEP 33 bloom filter,
+// estimated from the number of unset bits.
+func bloomEstimate(f []byte) int {
+	set := 0
+	for _, b := range f {
+		set += bits.OnesCount8(b)
+	}
+	unset := float64(bep33FilterBits - set)
+	if unset == 0 {
+		unset = 1
+	}
+	m := float64(bep33FilterBits)
+	return int(math.Round(math.Log(unset/m) / (2 * math.Log(1-1/m))))
+}
+
+func (ss *swarmSampler) logStats() {
+	ss.mu.Lock()
+	n, inflight := ss.samples, len(ss.inflight)
+	ss.mu.Unlock()
+	log.Printf("Swarm Samples:\tsampled %d\tin flight %d", n, inflight)
+}
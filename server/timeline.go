@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// timelineOrigin is the unix time timeline buckets are counted from,
+// Monday 1970-01-05 00:00 UTC, so days start at midnight UTC and weeks on
+// Mondays.
+const timelineOrigin = 345600
+
+// TimelineEntry holds the top torrents of one timeline bucket, which starts
+// at Start.
+type TimelineEntry struct {
+	Start    time.Time
+	Torrents []TimelineTorrent
+}
+
+// TimelineTorrent is a torrent in a timeline bucket. Count is its activity
+// in the bucket: announces or announcers, lookups or both, depending on the
+// RankMode and AnnounceCounter.
+type TimelineTorrent struct {
+	Torrent
+	Count int
+}
+
+// HistoryBucket counts the activity of a torrent in one bucket of its
+// history, which starts at Start. Announces counts every announce, repeats
+// included, from the hourly and daily announce counts, and Announcers the
+// distinct nodes that announced it for the first time.
+type HistoryBucket struct {
+	Start      time.Time
+	Announces  int
+	Announcers int
+}
+
+// Granularity is the length of the buckets of a timeline.
+type Granularity int
+
+const (
+	// GranularityHour buckets torrents by hour.
+	GranularityHour Granularity = iota
+	// GranularityDay buckets torrents by UTC day.
+	GranularityDay
+	// GranularityWeek buckets torrents by week, starting on Mondays.
+	GranularityWeek
+)
+
+var granularityNames = map[Granularity]string{
+	GranularityHour: "hour",
+	GranularityDay:  "day",
+	GranularityWeek: "week",
+}
+
+// ParseGranularity returns the Granularity named s.
+func ParseGranularity(s string) (Granularity, error) {
+	for g, n := range granularityNames {
+		if n == s {
+			return g, nil
+		}
+	}
+	return GranularityDay, fmt.Errorf("Unknown granularity: %s", s)
+}
+
+func (g Granularity) String() string {
+	return granularityNames[g]
+}
+
+// seconds returns the length of a bucket.
+func (g Granularity) seconds() int64 {
+	switch g {
+	case GranularityHour:
+		return 3600
+	case GranularityWeek:
+		return 7 * 86400
+	default:
+		return 86400
+	}
+}
+
+// timelineBuckets returns the empty entries of the last n buckets up to
+// now, newest first, and the number of the newest bucket.
+func timelineBuckets(now time.Time, n int, g Granularity) ([]TimelineEntry, int64) {
+	if n < 0 {
+		n = 0
+	}
+	size := g.seconds()
+	last := (now.Unix() - timelineOrigin) / size
+	ret := make([]TimelineEntry, n)
+	for i := range ret {
+		start := timelineOrigin + (last-int64(i))*size
+		ret[i] = TimelineEntry{time.Unix(start, 0).UTC(), make([]TimelineTorrent, 0)}
+	}
+	return ret, last
+}
+
+// historyBuckets returns the empty last n buckets up to now, oldest first,
+// and the number of the oldest bucket.
+func historyBuckets(now time.Time, n int, g Granularity) ([]HistoryBucket, int64) {
+	if n < 0 {
+		n = 0
+	}
+	size := g.seconds()
+	first := (now.Unix()-timelineOrigin)/size - int64(n) + 1
+	ret := make([]HistoryBucket, n)
+	for i := range ret {
+		ret[i].Start = time.Unix(timelineOrigin+(first+int64(i))*size, 0).UTC()
+	}
+	return ret, first
+}
+
+// timelineActivity returns the subquery of the activity mode ranks by, for
+// sqlTimelineTorrents, and its arguments for the time range from start
+// until end. Announces are counted with counter, and swarm sizes are ranked
+// among the torrents announced.
+func timelineActivity(mode RankMode, counter AnnounceCounter, start int64, end int64) (string, []interface{}) {
+	announce := sqlAnnouncerActivity
+	announces := []interface{}{start, end, start - rollupMidday, end - rollupMidday}
+	if counter == CountRaw {
+		announce = sqlAnnounceActivity
+		announces[0], announces[1] = start-hourMidpoint, end-hourMidpoint
+	}
+	lookups := []interface{}{start, end}
+	switch mode {
+	case RankDemand:
+		return sqlLookupActivity, lookups
+	case RankCombined:
+		return announce + " UNION ALL " + sqlLookupActivity, append(announces, lookups...)
+	default:
+		return announce, announces
+	}
+}
+
+// timelineScore returns the expression ranking torrents within a bucket of
+// sqlTimelineTorrents.
+func timelineScore(mode RankMode) string {
+	if mode == RankSwarm {
+		return "t.swarm_size"
+	}
+	return "c.cnt"
+}
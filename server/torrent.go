@@ -1,6 +1,9 @@
 package server
 
 import (
+	"strings"
+	"time"
+
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
@@ -17,6 +20,67 @@ var (
 	}
 )
 
+// MetaInfoForInfoBytes returns a complete MetaInfo for the bencoded info
+// dictionary ib, with trackers from announceList.
+func MetaInfoForInfoBytes(ib []byte, announceList [][]string) (*metainfo.MetaInfo, error) {
+	var i metainfo.Info
+	if err := bencode.Unmarshal(ib, &i); err != nil {
+		return nil, err
+	}
+	mi := &metainfo.MetaInfo{AnnounceList: announceList, InfoBytes: ib}
+	if len(announceList) > 0 && len(announceList[0]) > 0 {
+		mi.Announce = announceList[0][0]
+	}
+	mi.SetDefaults()
+	return mi, nil
+}
+
+// infoFiles returns the files of i with their full paths. The file of a
+// single-file torrent is named after the torrent.
+func infoFiles(i *metainfo.Info) []FileInfo {
+	ret := make([]FileInfo, 0, len(i.UpvertedFiles()))
+	for n, fi := range i.UpvertedFiles() {
+		p := strings.Join(fi.Path, "/")
+		if len(i.Files) == 0 {
+			p = i.Name
+		}
+		ret = append(ret, FileInfo{Path: p, Length: fi.Length, Index: n})
+	}
+	return ret
+}
+
+// The torrent client builds the metainfo of torrents it only has the info
+// dictionary of with this comment and creator, and the current time as the
+// creation date. None of it describes the torrent, so it isn't stored.
+const (
+	clientMetainfoComment   = "dynamic metainfo from client"
+	clientMetainfoCreatedBy = "go.torrent"
+)
+
+// torrentMeta returns the metadata to store for i. The fields of mi outside
+// the info dictionary are skipped if it is nil or was made up by the torrent
+// client, as for torrents resolved from the DHT, since only the info
+// dictionary is exchanged.
+func torrentMeta(i *metainfo.Info, mi *metainfo.MetaInfo) TorrentMeta {
+	m := TorrentMeta{
+		Name:        i.Name,
+		Length:      i.TotalLength(),
+		PieceLength: i.PieceLength,
+		FileCount:   len(i.UpvertedFiles()),
+		Private:     i.Private != nil && *i.Private,
+		Source:      i.Source,
+	}
+	m.Category, m.CategoryConfidence = Classify(infoFiles(i))
+	if mi != nil && (mi.Comment != clientMetainfoComment || mi.CreatedBy != clientMetainfoCreatedBy) {
+		if mi.CreationDate > 0 {
+			m.CreationDate = time.Unix(mi.CreationDate, 0)
+		}
+		m.Comment = mi.Comment
+		m.CreatedBy = mi.CreatedBy
+	}
+	return m
+}
+
 func seedTorrentSpec(cl *torrent.Client, ts *torrent.TorrentSpec) (*torrent.Torrent, error) {
 	t, _, err := cl.AddTorrentSpec(ts)
 	return t, err
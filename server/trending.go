@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rollupMidday is the second of its day a rolled up announce is counted at
+// by TrendingTorrents, as the time it was made isn't kept.
+const rollupMidday = 43200
+
+// hourMidpoint is the second of its hour an announce counted in
+// announce_hourly is counted at.
+const hourMidpoint = 1800
+
+// TrendingTorrent is a torrent ranked by its recent announces. Current and
+// Previous count announces, repeats included, in the trend window ending now
+// and in the window before it. Score is what the TrendView ranks by.
+type TrendingTorrent struct {
+	Torrent
+	Current  int
+	Previous int
+	Score    float64
+}
+
+// TrendView selects how TrendingTorrents ranks torrents.
+type TrendView int
+
+const (
+	// TrendHot ranks torrents by announces in the window, each weighted
+	// down linearly with its age, times an acceleration factor. The factor
+	// is 1 for a torrent announced as often as in the previous window and
+	// tends to 2 for a new one and 0 for one going quiet.
+	TrendHot TrendView = iota
+	// TrendRising ranks torrents by how many more announces they had than
+	// in the previous window.
+	TrendRising
+	// TrendFalling ranks torrents by how many fewer announces they had than
+	// in the previous window.
+	TrendFalling
+)
+
+var trendViewNames = map[TrendView]string{
+	TrendHot:     "hot",
+	TrendRising:  "rising",
+	TrendFalling: "falling",
+}
+
+// ParseTrendView returns the TrendView named s.
+func ParseTrendView(s string) (TrendView, error) {
+	for v, n := range trendViewNames {
+		if n == s {
+			return v, nil
+		}
+	}
+	return TrendHot, fmt.Errorf("Unknown trend view: %s", s)
+}
+
+func (v TrendView) String() string {
+	return trendViewNames[v]
+}
+
+// where returns the condition on the window counts a and the score
+// expression of v for sqlTrendingTorrents to pick the top torrents by.
+// score computes the same.
+func (v TrendView) where() (string, string) {
+	switch v {
+	case TrendRising:
+		return "a.cur > a.prev", "a.cur - a.prev"
+	case TrendFalling:
+		return "a.prev > a.cur", "a.prev - a.cur"
+	default:
+		return "a.cur > 0", "a.decayed * 2.0 * (a.cur + 1) / (a.cur + a.prev + 2)"
+	}
+}
+
+// score returns the score of a torrent with cur and prev announces and the
+// decayed announce count, and whether v lists it at all.
+func (v TrendView) score(cur int, prev int, decayed float64) (float64, bool) {
+	switch v {
+	case TrendRising:
+		return float64(cur - prev), cur > prev
+	case TrendFalling:
+		return float64(prev - cur), prev > cur
+	default:
+		return decayed * 2.0 * float64(cur+1) / float64(cur+prev+2), cur > 0
+	}
+}
+
+// trendWindow is a trend window ending now and the window before it, as
+// the unix times they start and their length in seconds.
+type trendWindow struct {
+	start, prev, length int64
+}
+
+func newTrendWindow(now time.Time, window time.Duration) trendWindow {
+	return trendWindow{now.Add(-window).Unix(), now.Add(-2 * window).Unix(), int64(window / time.Second)}
+}
+
+// trendCounts are the announces of a torrent in a trend window and the
+// window before it, and those in the window weighted from 0 at its start to
+// 1 now.
+type trendCounts struct {
+	cur, prev int
+	decayed   float64
+}
+
+// add counts n announces made at seen in c, like the sums of
+// sqlTrendingTorrents.
+func (w trendWindow) add(c *trendCounts, seen int64, n int) {
+	switch {
+	case seen > w.start:
+		c.cur += n
+		c.decayed += float64(int64(n)*(seen-w.start)) / float64(w.length)
+	case seen > w.prev:
+		c.prev += n
+	}
+}
+
+// trending returns t with counts c scored by v, and whether v lists it.
+func (c trendCounts) trending(t Torrent, v TrendView) (TrendingTorrent, bool) {
+	score, ok := v.score(c.cur, c.prev, c.decayed)
+	return TrendingTorrent{t, c.cur, c.prev, score}, ok
+}
+
+// ParseTrendWindow parses a trend window like 1h, 24h or 7d, where a day is
+// 24 hours. Announces are counted by hour, so windows must be whole hours.
+func ParseTrendWindow(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err == nil && n > 0 {
+			return time.Duration(n) * time.Hour * 24, nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		if d%time.Hour != 0 {
+			return 0, fmt.Errorf("Trend windows must be whole hours: %s", s)
+		}
+		return d, nil
+	}
+	return 0, fmt.Errorf("Invalid trend window: %s", s)
+}